@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long after a start a process is audited, so it has had time to set itself up
+const auditDelay = time.Second
+
+// What a running process has received from the runner
+type auditReport struct {
+	// Open file descriptors other than stdin, stdout and stderr, as "fd=target"
+	fds []string
+
+	// Names of environment variables passed through from the runner's own environment unchanged
+	inheritedEnv []string
+
+	// File mode creation mask, empty if the kernel does not report it
+	umask string
+}
+
+// Audit a process shortly after it started and log what it has received from the runner
+// Only works where /proc is available, elsewhere the audit fails and says so
+func (pm *processManager) auditProcess(pid int, incarnation string, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-pm.clock.After(auditDelay):
+	}
+
+	report, err := auditPid(pid)
+	if err != nil {
+		slog.Warn("audit_failed", "process", pm.cmd.name, "incarnation", incarnation, "error", err)
+		return
+	}
+
+	slog.Info("audit_report", "process", pm.cmd.name, "incarnation", incarnation,
+		"fds", report.fds, "inherited_env", report.inheritedEnv, "umask", report.umask)
+}
+
+// Collect the audit report for a process from /proc
+func auditPid(pid int) (auditReport, error) {
+	var report auditReport
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	// File descriptors beyond stdio, with what they point to
+	entries, err := os.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return report, err
+	}
+
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil || fd <= 2 {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(dir, "fd", entry.Name()))
+		if err != nil {
+			target = "?"
+		}
+
+		report.fds = append(report.fds, fmt.Sprintf("%d=%s", fd, target))
+	}
+
+	// Variables the process got from the runner as they are, only the names so no secrets are logged
+	environ, err := os.ReadFile(filepath.Join(dir, "environ"))
+	if err != nil {
+		return report, err
+	}
+
+	own := os.Environ()
+	for _, entry := range bytes.Split(environ, []byte{0}) {
+		if len(entry) > 0 && slices.Contains(own, string(entry)) {
+			name, _, _ := strings.Cut(string(entry), "=")
+			report.inheritedEnv = append(report.inheritedEnv, name)
+		}
+	}
+	slices.Sort(report.inheritedEnv)
+
+	// The umask is only reported by newer kernels
+	status, err := os.Open(filepath.Join(dir, "status"))
+	if err != nil {
+		return report, err
+	}
+	defer status.Close()
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "Umask:"); found {
+			report.umask = strings.TrimSpace(value)
+		}
+	}
+
+	return report, scanner.Err()
+}
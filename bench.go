@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Run as a dummy process for -bench-startup
+// Stays alive until stdin is closed, which happens when the parent exits
+func runBenchChild() {
+	io.Copy(io.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+// Start n dummy processes at once, one goroutine per process, and report how long it took
+// The processes are started with plain exec.Command without a process manager or output sink,
+// so this measures the cost of starting processes and not the supervision around them
+func runStartupBenchmark(n int) {
+	// The dummy processes are this program started with -bench-child
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("failed_to_find_executable", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("bench_startup_begin", "processes", n)
+
+	var wg sync.WaitGroup
+	processes := make([]*exec.Cmd, n)
+	stdins := make([]io.WriteCloser, n)
+	latencies := make([]time.Duration, n)
+	failed := 0
+	var failedMu sync.Mutex
+
+	begin := time.Now()
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			started := time.Now()
+
+			process := exec.Command(exe, "-bench-child")
+			stdin, err := process.StdinPipe()
+			if err == nil {
+				err = process.Start()
+			}
+
+			latencies[i] = time.Since(started)
+
+			if err != nil {
+				slog.Warn("process_failed", "process", i, "error", err)
+				failedMu.Lock()
+				failed++
+				failedMu.Unlock()
+				return
+			}
+
+			processes[i] = process
+			stdins[i] = stdin
+		}(i)
+	}
+
+	wg.Wait()
+	total := time.Since(begin)
+
+	// Sys only grows, so it is close to the peak memory used by the runner itself
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// Stop the dummy processes by closing their stdin
+	for i, process := range processes {
+		if process != nil {
+			stdins[i].Close()
+			process.Wait()
+		}
+	}
+
+	slices.Sort(latencies)
+
+	slog.Info("bench_startup_report",
+		"processes", n,
+		"failed", failed,
+		"time_to_all_started", total,
+		"latency_min", latencies[0],
+		"latency_median", latencies[n/2],
+		"latency_p95", latencies[n*95/100],
+		"latency_max", latencies[n-1],
+		"runner_sys_bytes", mem.Sys,
+		"runner_heap_inuse_bytes", mem.HeapInuse)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// How long to wait for a TLS endpoint when checking its certificate
+const certDialTimeout = 10 * time.Second
+
+// Check the given certificates now and then every interval,
+// logging the days left until each expires and warning when few are left
+// A source is either a PEM file or a host:port to connect to with TLS
+func watchCertificates(sources []string, interval time.Duration, warnDays int) {
+	for {
+		for _, source := range sources {
+			checkCertificate(source, warnDays)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Check a single certificate source and log the result
+func checkCertificate(source string, warnDays int) {
+	expires, err := certificateExpiry(source)
+	if err != nil {
+		slog.Warn("certificate_check_failed", "certificate", source, "error", err)
+		return
+	}
+
+	daysLeft := int(time.Until(expires).Hours() / 24)
+
+	switch {
+	case daysLeft < 0:
+		slog.Error("certificate_expired", "certificate", source, "expires", expires)
+	case daysLeft <= warnDays:
+		slog.Warn("certificate_expiring", "certificate", source, "expires", expires, "days_left", daysLeft)
+	default:
+		slog.Info("certificate_checked", "certificate", source, "expires", expires, "days_left", daysLeft)
+	}
+}
+
+// Return when the first certificate from a source expires
+// Sources that exist as files are read as PEM, anything else is treated as host:port
+func certificateExpiry(source string) (time.Time, error) {
+	if _, err := os.Stat(source); err == nil {
+		return fileCertificateExpiry(source)
+	}
+
+	return endpointCertificateExpiry(source)
+}
+
+// Return when the first certificate in a PEM file expires
+func fileCertificateExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var first time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if first.IsZero() || cert.NotAfter.Before(first) {
+			first = cert.NotAfter
+		}
+	}
+
+	if first.IsZero() {
+		return time.Time{}, errors.New("no certificate found in file")
+	}
+
+	return first, nil
+}
+
+// Return when the certificate served by a TLS endpoint expires
+func endpointCertificateExpiry(address string) (time.Time, error) {
+	// The certificate is only inspected, so an invalid or expired one must not stop the check
+	dialer := &net.Dialer{Timeout: certDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, errors.New("endpoint sent no certificate")
+	}
+
+	return certs[0].NotAfter, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Actions the runner can be asked to do, given as the first argument before the flags
+var subcommands = []struct {
+	name, summary string
+
+	// Flags that apply to the subcommand, nil for all of them
+	flags []string
+}{
+	{"run", "start the commands and keep them running (the default)", nil},
+	{"validate", "check the commands and print their settings without starting anything", []string{
+		"f", "config", "restart", "on-failure", "expand-env", "grace", "secret-key-file",
+	}},
+	{"status", "print the status of a running runner, asked for on its -control socket", []string{"control"}},
+	{"ctl", "manage a running runner through its -control socket: status, restart NAME or group restart|stop|start NAME", []string{"control", "json"}},
+	{"version", "print version and build information as JSON", []string{}},
+}
+
+// Split the arguments into the subcommand and its flags
+// Without a subcommand the runner runs, so scripts that only give flags keep working
+// Exits with 1 if the first argument is not a flag or a known subcommand
+func parseSubcommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "run", args
+	}
+
+	for _, sub := range subcommands {
+		if sub.name == args[0] {
+			return sub.name, args[1:]
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown subcommand %q\n\n", args[0])
+	printUsage()
+	os.Exit(1)
+
+	return "", nil
+}
+
+// Make -h show only the flags that apply to the subcommand
+func setSubcommandUsage(name string) {
+	flag.CommandLine.Init("lars-script-runner "+name, flag.ExitOnError)
+	flag.Usage = func() {
+		for _, sub := range subcommands {
+			if sub.name != name {
+				continue
+			}
+
+			if sub.flags != nil && len(sub.flags) == 0 {
+				fmt.Fprintf(os.Stderr, "Usage: lars-script-runner %s\n\n%s\n", name, sub.summary)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Usage: lars-script-runner %s [flags]\n\n%s\n", name, sub.summary)
+
+			// Copy the flags that apply into a set of their own to print them
+			applies := flag.NewFlagSet(name, flag.ContinueOnError)
+			applies.SetOutput(os.Stderr)
+			flag.VisitAll(func(f *flag.Flag) {
+				if sub.flags == nil || slices.Contains(sub.flags, f.Name) {
+					applies.Var(f.Value, f.Name, f.Usage)
+				}
+			})
+
+			fmt.Fprintln(os.Stderr, "\nFlags:")
+			applies.PrintDefaults()
+		}
+
+		fmt.Fprintln(os.Stderr)
+		printUsage()
+	}
+}
+
+// Print the list of subcommands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lars-script-runner [subcommand] [flags]\n\nSubcommands:")
+	for _, sub := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", sub.name, sub.summary)
+	}
+}
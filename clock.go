@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Source of time for the supervision loop
+// Lets the restart timing be driven by something other than the wall clock
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// How often to look for clock jumps and how big a jump has to be to be reported
+const (
+	clockJumpInterval  = 10 * time.Second
+	clockJumpThreshold = 5 * time.Second
+)
+
+// Watch for the wall clock moving differently from the monotonic clock
+// This happens when the system clock is set, or after a suspend on systems
+// whose monotonic clock stops while suspended
+// Jumps are logged so they are not mistaken for misbehaving processes
+func watchClockJumps() {
+	last := time.Now()
+
+	ticker := time.NewTicker(clockJumpInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		// Sub uses the monotonic readings, Round(0) strips them to compare wall times
+		monotonic := now.Sub(last)
+		wall := now.Round(0).Sub(last.Round(0))
+		jump := wall - monotonic
+
+		if jump > clockJumpThreshold || jump < -clockJumpThreshold {
+			slog.Warn("clock_jump", "wall_elapsed", wall, "monotonic_elapsed", monotonic, "jump", jump)
+		}
+
+		last = now
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Restart delay used when none is configured, this was the fixed delay before it became configurable
+const defaultRestartDelay = time.Second
+
+// Attempt window used when only the number of attempts is configured
+const defaultAttemptWindow = 10 * time.Second
+
+// Start limit interval used when only the burst is configured
+const defaultStartLimitInterval = 10 * time.Second
+
+// Time without connections after which an on-demand process is stopped, when none is configured
+const defaultIdleTimeout = 10 * time.Minute
+
+// Restart policies, deciding whether a process is started again after it exits
+const (
+	// Always restart, this is what the runner has always done
+	restartAlways = "always"
+
+	// Only restart if the process did not exit cleanly
+	restartOnFailure = "on-failure"
+
+	// Run the process once
+	restartNever = "never"
+)
+
+// Check whether a restart policy is known
+func validRestartPolicy(policy string) bool {
+	return policy == restartAlways || policy == restartOnFailure || policy == restartNever
+}
+
+// A command to run, the name it is known by in logs and output, and how it is supervised
+type command struct {
+	name string
+	line string
+
+	// The command line split into the executable and its arguments
+	args []string
+
+	// Time to wait after the command exits before starting it again
+	restartDelay time.Duration
+
+	// When to restart the command after it exits, see restartAlways and friends
+	restart string
+
+	// Exit codes that count as a successful run, nil means only 0
+	successCodes []int
+
+	// How long the command gets to exit after being asked to terminate before it is killed
+	grace time.Duration
+
+	// Longest a single run may last before it is stopped and restarted, 0 for no limit
+	maxRuntime time.Duration
+
+	// How many times the command is tried within one run, a failed attempt that ends
+	// within attemptWindow is tried again straight away instead of counting as a failure
+	attempts      int
+	attemptWindow time.Duration
+
+	// How many times in a row a failed run is retried before giving up, 0 for no limit
+	maxRetries int
+
+	// How long a run has to last before earlier failures are forgotten
+	// Runs that end sooner count as failures, even if they exit successfully
+	minUptime time.Duration
+
+	// The command is given up on if it is started more than startLimitBurst times
+	// within startLimitInterval, a burst of 0 means there is no limit
+	startLimitBurst    int
+	startLimitInterval time.Duration
+
+	// Extra environment variables in KEY=value form, added to the runner's own environment
+	env []string
+
+	// Dotenv file with more environment variables, read on every start
+	envFile string
+
+	// Working directory, empty for the runner's own
+	dir string
+
+	// Whether $NAME and ${NAME} in the command line are replaced by environment variables
+	expandEnv bool
+
+	// Values decrypted from the configuration, masked in output and logs
+	secrets []string
+
+	// If set, the command is run on this schedule instead of being kept running
+	schedule *cronSchedule
+
+	// Command line run when the command is given up on, empty for none
+	onFailure string
+
+	// Names of the resources the command needs a slot of for every run, see resourcePool
+	resources []string
+
+	// Name of the group the command belongs to, empty for none
+	group string
+
+	// If listen is set, the command is only run while there are connections to it, see runOnDemand
+	listen      string
+	upstream    string
+	idleTimeout time.Duration
+}
+
+// Split the command line into the executable and its arguments
+// Environment variables are not expanded here, that happens on every start
+func (c *command) splitLine() error {
+	args, err := splitCommandLine(c.line, nil)
+	if err != nil {
+		return fmt.Errorf("process %q: %w", c.name, err)
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		return fmt.Errorf("process %q has no executable", c.name)
+	}
+
+	c.args = args
+	return nil
+}
+
+// Check that the failure hook, if any, can be split into an executable and its arguments
+func (c command) checkOnFailure() error {
+	if c.onFailure == "" {
+		return nil
+	}
+
+	args, err := splitCommandLine(c.onFailure, nil)
+	if err != nil {
+		return fmt.Errorf("on_failure: %w", err)
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		return errors.New("on_failure has no executable")
+	}
+
+	return nil
+}
+
+// Decide whether a run of the command that ended for the given reason was successful
+// Only runs that exited on their own with one of the success exit codes count
+func (c command) succeeded(reason exitReason) bool {
+	if reason.kind != "clean_exit" && reason.kind != "nonzero_exit" {
+		return false
+	}
+
+	if c.successCodes == nil {
+		return reason.code == 0
+	}
+
+	return slices.Contains(c.successCodes, reason.code)
+}
+
+// Decide whether the command is started again after exiting for the given reason
+func (c command) shouldRestart(reason exitReason) bool {
+	switch c.restart {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		return !c.succeeded(reason)
+	}
+
+	return true
+}
+
+// Return how long to wait before restarting the command after the given number of failed runs in a row
+// The wait starts at the restart delay and doubles with every failure, up to maxRestartBackoff
+func (c command) backoff(failures int) time.Duration {
+	delay := c.restartDelay
+	for i := 1; i < failures && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+
+	// A restart delay longer than the limit is still honoured
+	return max(min(delay, maxRestartBackoff), c.restartDelay)
+}
+
+// Create an exec.Cmd for a new run of the command
+// Also returns the secrets to mask in the output of this run, even with an error as the error can contain them
+// extraEnv is added to the environment, after the variables of the command
+func (c command) newProcess(extraEnv []string) (*exec.Cmd, []string, error) {
+	env, fileSecrets, err := c.environment()
+	if err != nil {
+		return nil, c.secrets, err
+	}
+	secrets := append(fileSecrets, c.secrets...)
+
+	if len(extraEnv) > 0 {
+		if env == nil {
+			env = os.Environ()
+		}
+		env = append(env, extraEnv...)
+	}
+
+	args, err := c.runArgs(env)
+	if err != nil {
+		return nil, secrets, err
+	}
+
+	process := exec.Command(args[0], args[1:]...)
+	process.Dir = c.dir
+	process.Env = env
+
+	return process, secrets, nil
+}
+
+// Replace the secrets from the configuration in a string that is about to be logged
+// Values from the environment file are only known per run, see newProcess
+func (c command) mask(s string) string {
+	return maskSecrets(s, c.secrets)
+}
+
+// Return the executable and arguments for a new run of the command
+// If environment variables are expanded, the values come from env,
+// or from the runner's own environment if env is nil
+func (c command) runArgs(env []string) ([]string, error) {
+	if !c.expandEnv {
+		return c.args, nil
+	}
+
+	if env == nil {
+		env = os.Environ()
+	}
+
+	// Later entries override earlier ones, like they do for the process itself
+	values := make(map[string]string)
+	for _, entry := range env {
+		if key, value, found := strings.Cut(entry, "="); found {
+			values[key] = value
+		}
+	}
+
+	args, err := splitCommandLine(c.line, func(key string) string { return values[key] })
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("command line expands to no executable")
+	}
+
+	return args, nil
+}
+
+// Build the environment for a new run of the command
+// The environment file is read every time, so rotated secrets are picked up on restart
+// Variables from env override those from the file, which override the runner's own
+// Returns nil to use the runner's own environment unchanged
+// The values from the environment file are returned as well, so they can be masked
+func (c command) environment() ([]string, []string, error) {
+	if c.envFile == "" && len(c.env) == 0 {
+		return nil, nil, nil
+	}
+
+	env := os.Environ()
+
+	var secrets []string
+	if c.envFile != "" {
+		fileEnv, err := readEnvFile(c.envFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		env = append(env, fileEnv...)
+
+		for _, entry := range fileEnv {
+			_, value, _ := strings.Cut(entry, "=")
+			secrets = append(secrets, value)
+		}
+	}
+
+	return append(env, c.env...), secrets, nil
+}
+
+// Layout of the YAML configuration file
+type configFile struct {
+	Templates map[string]processConfig `yaml:"templates,omitempty"`
+	Processes []processConfig          `yaml:"processes"`
+}
+
+// Settings for one process in the YAML configuration file
+// Settings that are left out use the defaults from the command line flags
+// Settings that are not set are left out when writing it, see resolvedConfig
+type processConfig struct {
+	Name               string            `yaml:"name"`
+	Command            string            `yaml:"command"`
+	Group              string            `yaml:"group,omitempty"`
+	Schedule           string            `yaml:"schedule,omitempty"`
+	Restart            string            `yaml:"restart,omitempty"`
+	OnFailure          string            `yaml:"on_failure,omitempty"`
+	RestartDelay       time.Duration     `yaml:"restart_delay,omitempty"`
+	SuccessCodes       []int             `yaml:"success_exit_codes,omitempty"`
+	GracePeriod        time.Duration     `yaml:"grace_period,omitempty"`
+	MaxRuntime         time.Duration     `yaml:"max_runtime,omitempty"`
+	Attempts           int               `yaml:"attempts,omitempty"`
+	AttemptWindow      time.Duration     `yaml:"attempt_window,omitempty"`
+	MaxRetries         int               `yaml:"max_retries,omitempty"`
+	MinUptime          time.Duration     `yaml:"min_uptime,omitempty"`
+	StartLimitBurst    int               `yaml:"start_limit_burst,omitempty"`
+	StartLimitInterval time.Duration     `yaml:"start_limit_interval,omitempty"`
+	Env                map[string]string `yaml:"env,omitempty"`
+	EnvFile            string            `yaml:"env_file,omitempty"`
+	WorkingDir         string            `yaml:"working_dir,omitempty"`
+	Resources          []string          `yaml:"resources,omitempty"`
+	Listen             string            `yaml:"listen,omitempty"`
+	Upstream           string            `yaml:"upstream,omitempty"`
+	IdleTimeout        time.Duration     `yaml:"idle_timeout,omitempty"`
+	Template           string            `yaml:"template,omitempty"`
+	Params             map[string]string `yaml:"params,omitempty"`
+}
+
+// Return the settings the command ends up with, in the form of the YAML configuration
+// Secrets are masked, so the result can be shown
+func (c command) resolvedConfig() processConfig {
+	p := processConfig{
+		Name:               c.name,
+		Command:            c.mask(c.line),
+		Group:              c.group,
+		Restart:            c.restart,
+		OnFailure:          c.onFailure,
+		RestartDelay:       c.restartDelay,
+		SuccessCodes:       c.successCodes,
+		GracePeriod:        c.grace,
+		MaxRuntime:         c.maxRuntime,
+		Attempts:           c.attempts,
+		AttemptWindow:      c.attemptWindow,
+		MaxRetries:         c.maxRetries,
+		MinUptime:          c.minUptime,
+		StartLimitBurst:    c.startLimitBurst,
+		StartLimitInterval: c.startLimitInterval,
+		EnvFile:            c.envFile,
+		WorkingDir:         c.dir,
+		Resources:          c.resources,
+		Listen:             c.listen,
+		Upstream:           c.upstream,
+		IdleTimeout:        c.idleTimeout,
+	}
+
+	if c.schedule != nil {
+		p.Schedule = c.schedule.spec
+	}
+
+	for _, entry := range c.env {
+		if p.Env == nil {
+			p.Env = make(map[string]string)
+		}
+
+		key, value, _ := strings.Cut(entry, "=")
+		p.Env[key] = c.mask(value)
+	}
+
+	return p
+}
+
+// Load commands and their settings from a YAML configuration file
+// key decrypts encrypted values, it may be nil if there are none
+func loadConfig(filePath string, defaults command, key []byte) []command {
+	// Print a message that we are loading the configuration
+	slog.Info("loading_config", "file", filePath)
+
+	// Open the file
+	file, err := os.Open(filePath)
+
+	// If the file could not be opened, exit the program
+	if err != nil {
+		slog.Error("failed_to_open", "file", filePath, "error", err)
+		os.Exit(1)
+	}
+
+	// Close the file when the function ends
+	defer file.Close()
+
+	// Read the commands from the file
+	commands, err := parseConfig(file, defaults, key)
+
+	// If the configuration is not valid, exit the program
+	if err != nil {
+		slog.Error("failed_to_parse", "file", filePath, "error", err)
+		os.Exit(1)
+	}
+
+	// Print a message that the configuration has been loaded
+	slog.Info("config_loaded", "file", filePath, "processes", len(commands))
+
+	return commands
+}
+
+// Read commands and their settings from a YAML configuration
+// defaults holds the settings used for anything a process leaves out
+// Commands and environment values may be encrypted, key is used to decrypt them
+func parseConfig(r io.Reader, defaults command, key []byte) ([]command, error) {
+	// Catch misspelled settings instead of silently ignoring them
+	var cfg configFile
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var commands []command
+	names := make(map[string]bool)
+
+	for i, p := range cfg.Processes {
+		p, err := cfg.applyTemplate(p)
+		if err != nil {
+			return nil, fmt.Errorf("process %d: %w", i+1, err)
+		}
+
+		if strings.TrimSpace(p.Command) == "" {
+			return nil, fmt.Errorf("process %d has no command", i+1)
+		}
+
+		// Like in the command file, processes without a name are known by their command line
+		// An encrypted command line is used as the name as it is, so the secret stays out of the logs
+		cmd := defaults
+		cmd.name = p.Name
+		if cmd.name == "" {
+			cmd.name = p.Command
+		}
+
+		line, err := decryptValue(p.Command, key)
+		if err != nil {
+			return nil, fmt.Errorf("process %q command: %w", cmd.name, err)
+		}
+		cmd.line = line
+
+		// Decrypted values must not show up in the output or the logs
+		cmd.secrets = nil
+		if isEncrypted(p.Command) {
+			cmd.secrets = append(cmd.secrets, line)
+		}
+
+		if names[cmd.name] {
+			return nil, fmt.Errorf("process name %q is used more than once", cmd.name)
+		}
+		names[cmd.name] = true
+
+		if err := cmd.splitLine(); err != nil {
+			return nil, err
+		}
+
+		if p.RestartDelay < 0 || p.GracePeriod < 0 || p.MaxRuntime < 0 || p.MaxRetries < 0 ||
+			p.MinUptime < 0 || p.StartLimitBurst < 0 || p.StartLimitInterval < 0 ||
+			p.Attempts < 0 || p.AttemptWindow < 0 || p.IdleTimeout < 0 {
+			return nil, fmt.Errorf("process %q has a negative setting", cmd.name)
+		}
+
+		if p.OnFailure != "" {
+			cmd.onFailure = p.OnFailure
+		}
+		if err := cmd.checkOnFailure(); err != nil {
+			return nil, fmt.Errorf("process %q %w", cmd.name, err)
+		}
+
+		if p.Schedule != "" {
+			if cmd.schedule, err = parseCronSchedule(p.Schedule); err != nil {
+				return nil, fmt.Errorf("process %q: %w", cmd.name, err)
+			}
+		}
+
+		if p.Restart != "" {
+			if !validRestartPolicy(p.Restart) {
+				return nil, fmt.Errorf("process %q has unknown restart policy %q", cmd.name, p.Restart)
+			}
+
+			cmd.restart = p.Restart
+		}
+		if p.RestartDelay > 0 {
+			cmd.restartDelay = p.RestartDelay
+		}
+		if p.GracePeriod > 0 {
+			cmd.grace = p.GracePeriod
+		}
+		if p.MaxRuntime > 0 {
+			cmd.maxRuntime = p.MaxRuntime
+		}
+		if p.Attempts > 0 {
+			cmd.attempts = p.Attempts
+			cmd.attemptWindow = defaultAttemptWindow
+		}
+		if p.AttemptWindow > 0 {
+			cmd.attemptWindow = p.AttemptWindow
+		}
+		if p.MaxRetries > 0 {
+			cmd.maxRetries = p.MaxRetries
+		}
+		if p.MinUptime > 0 {
+			cmd.minUptime = p.MinUptime
+		}
+
+		// Like systemd, the interval defaults to 10 seconds once a burst is set
+		if p.StartLimitBurst > 0 {
+			cmd.startLimitBurst = p.StartLimitBurst
+			cmd.startLimitInterval = defaultStartLimitInterval
+		}
+		if p.StartLimitInterval > 0 {
+			cmd.startLimitInterval = p.StartLimitInterval
+		}
+
+		if p.SuccessCodes != nil {
+			cmd.successCodes = p.SuccessCodes
+		}
+
+		cmd.dir = p.WorkingDir
+		cmd.envFile = p.EnvFile
+		cmd.group = strings.TrimSpace(p.Group)
+
+		for _, resource := range p.Resources {
+			if strings.TrimSpace(resource) == "" {
+				return nil, fmt.Errorf("process %q has an empty resource name", cmd.name)
+			}
+		}
+		cmd.resources = slices.Clone(p.Resources)
+		slices.Sort(cmd.resources)
+		cmd.resources = slices.Compact(cmd.resources)
+
+		// On-demand processes are started by connections instead of being kept running
+		if (p.Listen == "") != (p.Upstream == "") {
+			return nil, fmt.Errorf("process %q needs both listen and upstream to run on demand", cmd.name)
+		}
+		if p.Listen != "" && cmd.schedule != nil {
+			return nil, fmt.Errorf("process %q can not run both on a schedule and on demand", cmd.name)
+		}
+		if p.IdleTimeout > 0 && p.Listen == "" {
+			return nil, fmt.Errorf("process %q has an idle_timeout but does not run on demand", cmd.name)
+		}
+		cmd.listen = p.Listen
+		cmd.upstream = p.Upstream
+		cmd.idleTimeout = 0
+		if p.Listen != "" {
+			cmd.idleTimeout = defaultIdleTimeout
+			if p.IdleTimeout > 0 {
+				cmd.idleTimeout = p.IdleTimeout
+			}
+		}
+
+		// Sort the variables so the environment is the same on every start
+		cmd.env = nil
+		for name, value := range p.Env {
+			plain, err := decryptValue(value, key)
+			if err != nil {
+				return nil, fmt.Errorf("process %q variable %s: %w", cmd.name, name, err)
+			}
+
+			if isEncrypted(value) {
+				cmd.secrets = append(cmd.secrets, plain)
+			}
+			value = plain
+
+			cmd.env = append(cmd.env, name+"="+value)
+		}
+		slices.Sort(cmd.env)
+
+		commands = append(commands, cmd)
+	}
+
+	return commands, nil
+}
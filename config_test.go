@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Parsing any configuration must not panic, and every command returned
+// must have a name and an executable
+func FuzzParseConfig(f *testing.F) {
+	f.Add("processes:\n  - name: web\n    command: ./server -p 8080\n    restart_delay: 5s\n    env:\n      PORT: \"8080\"\n")
+	f.Add("processes:\n  - command: \"   \"\n")
+	f.Add("processes:\n  - command: a\n  - command: a\n")
+	f.Add("processes: [{command: x, grace_period: -1s}]")
+	f.Add("processes: [{command: \"ENC[aGVsbG8=]\"}]")
+	f.Add("templates:\n  w: {command: \"run {{q}}\", params: {q: a}}\nprocesses:\n  - {name: \"w-{{q}}\", template: w}\n  - {template: w, params: {q: b}}\n  - {template: nope}\n")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		commands, err := parseConfig(strings.NewReader(data), command{}, nil)
+		if err != nil {
+			return
+		}
+
+		for _, cmd := range commands {
+			if cmd.name == "" {
+				t.Fatalf("command %q has no name", cmd.line)
+			}
+
+			if len(cmd.args) == 0 || cmd.args[0] == "" {
+				t.Fatalf("command %q has no executable", cmd.line)
+			}
+		}
+	})
+}
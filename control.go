@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// How long the status subcommand waits for the runner to answer
+const controlTimeout = 10 * time.Second
+
+// Listen on a Unix domain socket for the control interface
+// Only the user running the runner can connect, and a socket left behind by a runner that is gone is replaced
+func listenControl(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		// Only ever remove a socket, a typo in -control must not delete a file that happens to be there
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another runner is listening on %s", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Windows does not use file modes for sockets, who can connect there follows the folder's permissions
+	if runtime.GOOS == "windows" {
+		return net.Listen("unix", path)
+	}
+
+	// The socket is created in a directory only this user can enter and made private before it is moved into place,
+	// so there is no moment in which others can connect to it
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".lsr-control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the listener would remove the temporary name, the socket is removed from its final place instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(filepath.Join(dir, "socket"), 0o600)
+	if err == nil {
+		err = os.Rename(filepath.Join(dir, "socket"), path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return controlListener{Listener: listener, path: path}, nil
+}
+
+// Listener that removes the control socket when it is closed
+type controlListener struct {
+	net.Listener
+	path string
+}
+
+func (l controlListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Asks the main goroutine to restart, stop or start a process or all processes of a group, the result is sent on done
+type processRequest struct {
+	action string
+	group  bool
+	name   string
+	done   chan error
+}
+
+// Prefix of the paths of the control interface, bumped when a change would break clients
+const controlAPIPrefix = "/api/v1/"
+
+// Description of the control interface for generating clients, served at /api/v1/openapi.json
+//
+//go:embed openapi.json
+var controlOpenAPI []byte
+
+// Body of every answer that is an error
+type controlError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Write an answer with a JSON body
+func writeControlJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// Write an error answer, code is a short machine readable name for the error like not_found
+func writeControlError(w http.ResponseWriter, status int, code, message string) {
+	var body controlError
+	body.Error.Code = code
+	body.Error.Message = message
+
+	writeControlJSON(w, status, body)
+}
+
+// Check the method of a request, answering with an error if it is not the expected one
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeControlError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use "+method)
+	return false
+}
+
+// Serve the control interface until the listener is closed
+// GET /api/v1/status returns a status snapshot, POST /api/v1/reload reloads the configuration like SIGHUP
+// POST /api/v1/processes/NAME/restart restarts a process and POST /api/v1/groups/NAME/ACTION restarts, stops or starts
+// all processes of a group
+func serveControl(listener net.Listener, snapshot func() statusSnapshot, reload chan<- struct{}, requests chan<- processRequest) {
+	// Requests are routed here instead of by http.ServeMux, which would clean paths and so break process names
+	// like ./script.sh that are part of the path
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+
+		switch {
+		case path == controlAPIPrefix+"openapi.json":
+			if allowMethod(w, r, http.MethodGet) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(controlOpenAPI)
+			}
+		case path == controlAPIPrefix+"status":
+			if allowMethod(w, r, http.MethodGet) {
+				writeControlJSON(w, http.StatusOK, snapshot())
+			}
+		case path == controlAPIPrefix+"reload":
+			if allowMethod(w, r, http.MethodPost) {
+				slog.Info("control_reload_requested")
+
+				// A reload that is already waiting covers this one too
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+
+				writeControlJSON(w, http.StatusAccepted, map[string]bool{"reload_requested": true})
+			}
+		case strings.HasPrefix(path, controlAPIPrefix+"processes/") && strings.HasSuffix(path, "/restart"):
+			if allowMethod(w, r, http.MethodPost) {
+				name, ok := controlPathName(w, "process", strings.TrimSuffix(strings.TrimPrefix(path, controlAPIPrefix+"processes/"), "/restart"))
+				if ok {
+					controlProcesses(w, processRequest{action: "restart", name: name}, requests)
+				}
+			}
+		case strings.HasPrefix(path, controlAPIPrefix+"groups/"):
+			rest := strings.TrimPrefix(path, controlAPIPrefix+"groups/")
+			slash := strings.LastIndexByte(rest, '/')
+			action := rest[slash+1:]
+			if slash < 0 || (action != "restart" && action != "stop" && action != "start") {
+				writeControlError(w, http.StatusNotFound, "not_found", "no such endpoint "+path)
+				return
+			}
+
+			if allowMethod(w, r, http.MethodPost) {
+				name, ok := controlPathName(w, "group", rest[:slash])
+				if ok {
+					controlProcesses(w, processRequest{action: action, group: true, name: name}, requests)
+				}
+			}
+		default:
+			writeControlError(w, http.StatusNotFound, "not_found", "no such endpoint "+path)
+		}
+	}
+
+	slog.Info("control_listening", "socket", listener.Addr().String())
+
+	err := http.Serve(listener, http.HandlerFunc(handler))
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("control_failed", "error", err)
+	}
+}
+
+// Unescape the name of a process or group from a path, answering with an error if it is not a single path segment
+func controlPathName(w http.ResponseWriter, kind, escaped string) (string, bool) {
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" || strings.Contains(escaped, "/") {
+		writeControlError(w, http.StatusBadRequest, "invalid_"+kind+"_name", "the "+kind+" name must be one escaped path segment")
+		return "", false
+	}
+
+	return name, true
+}
+
+// Ask the main goroutine to restart, stop or start processes and answer with the result
+func controlProcesses(w http.ResponseWriter, req processRequest, requests chan<- processRequest) {
+	kind := "process"
+	if req.group {
+		kind = "group"
+	}
+	slog.Info("control_"+req.action+"_requested", kind, req.name)
+
+	req.done = make(chan error, 1)
+	requests <- req
+	if err := <-req.done; err != nil {
+		writeControlError(w, http.StatusNotFound, kind+"_not_found", err.Error())
+		return
+	}
+
+	// Like {"group": "workers", "stopped": true}
+	done := map[string]string{"restart": "restarted", "stop": "stopped", "start": "started"}[req.action]
+	writeControlJSON(w, http.StatusOK, map[string]any{kind: req.name, done: true})
+}
+
+// Print the status of the runner listening on the control socket as JSON, then exit
+func runStatus(path string) {
+	body, err := controlRequest(path, http.MethodGet, controlAPIPrefix+"status")
+	if err != nil {
+		slog.Error("status_failed", "socket", path, "error", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(body)
+	os.Exit(0)
+}
+
+// Send a request to the runner listening on the control socket and return the body of the answer
+// Answers other than 2xx are returned as an error with the message from the body
+func controlRequest(path, method, target string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("give the socket of the runner with -control")
+	}
+
+	client := http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	// The host is not used, the connection always goes to the socket
+	req, err := http.NewRequest(method, "http://runner"+target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var answer controlError
+		if json.Unmarshal(body, &answer) == nil && answer.Error.Message != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, answer.Error.Message)
+		}
+
+		return nil, errors.New(resp.Status)
+	}
+
+	return body, nil
+}
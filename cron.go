@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Split a line like @cron "0 3 * * *" ./backup.sh into the schedule and the command line
+// The schedule can also be one of the shorthands, like @cron @daily ./backup.sh
+// Lines that do not start with @cron are returned unchanged with an empty schedule
+func splitScheduledLine(line string) (string, string, error) {
+	rest, found := strings.CutPrefix(line, "@cron")
+	if !found || rest == "" || !unicode.IsSpace(rune(rest[0])) {
+		return "", line, nil
+	}
+	rest = strings.TrimSpace(rest)
+
+	var spec string
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return "", "", errors.New("schedule has no closing quote")
+		}
+
+		spec, rest = rest[1:end+1], rest[end+2:]
+	} else {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+
+		spec, rest = rest[:end], rest[end:]
+	}
+
+	rest = strings.TrimSpace(rest)
+	if strings.TrimSpace(spec) == "" || rest == "" {
+		return "", "", errors.New("expected @cron \"schedule\" command")
+	}
+
+	return spec, rest, nil
+}
+
+// Shorthands for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// A schedule in the usual five field cron format: minute, hour, day of month, month and day of week
+// Each field is a bit set of the values it matches
+type cronSchedule struct {
+	// The schedule as it was given
+	spec string
+
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day fields start with "*", if neither does a day matches if either day field matches
+	domStar, dowStar bool
+}
+
+// Range of values for each field
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse a cron schedule like "0 3 * * *" or one of the shorthands like "@daily"
+// Fields can be *, a number, a range like 1-5, a list like 1,15 and have a step like */10
+// Day of week 0 and 7 are both Sunday
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	original := strings.TrimSpace(spec)
+	spec = original
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q must have 5 fields", spec)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q %s: %w", spec, cronFields[i].name, err)
+		}
+
+		sets[i] = set
+	}
+
+	// Sunday can be given as 7 too
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	schedule := &cronSchedule{
+		spec:    original,
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+
+	// Catch schedules like "0 0 30 2 *" that never run
+	if schedule.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", spec)
+	}
+
+	return schedule, nil
+}
+
+// Parse a single field of a cron schedule into a bit set of the values it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		// An optional step after the range
+		step := 1
+		if rangePart, stepPart, found := strings.Cut(part, "/"); found {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+
+			part, step = rangePart, n
+		}
+
+		// The range is *, a single value or first-last
+		first, last := min, max
+		if part != "*" {
+			firstPart, lastPart, isRange := strings.Cut(part, "-")
+
+			var err error
+			if first, err = strconv.Atoi(firstPart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", firstPart)
+			}
+
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(lastPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", lastPart)
+				}
+			} else if step > 1 {
+				// Like in other crons, "5/10" means from 5 to the end in steps of 10
+				last = max
+			}
+		}
+
+		if first < min || last > max || first > last {
+			return 0, errors.New("value out of range")
+		}
+
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+// Check whether the schedule runs on the day of t
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+
+	// Like in other crons, if both day fields are restricted either one may match
+	if !s.domStar && !s.dowStar {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// Return the first time after t that the schedule runs, in the location of t
+// Returns the zero time if the schedule does not run in the next few years
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
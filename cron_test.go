@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Parsing any schedule must not panic, and the next run of a valid schedule
+// must be later than the time it is computed from and match the schedule
+func FuzzParseCronSchedule(f *testing.F) {
+	f.Add("0 3 * * *")
+	f.Add("*/15 9-17 * * 1-5")
+	f.Add("0 0 1,15 * 7")
+	f.Add("5/10 * 31 2,4 *")
+	f.Add("@weekly")
+	f.Add("60 24 0 13 8")
+
+	f.Fuzz(func(t *testing.T, spec string) {
+		schedule, err := parseCronSchedule(spec)
+		if err != nil {
+			return
+		}
+
+		from := time.Date(2024, 2, 28, 23, 59, 30, 0, time.UTC)
+		next := schedule.next(from)
+
+		if !next.After(from) {
+			t.Fatalf("next run %v of %q is not after %v", next, spec, from)
+		}
+
+		if schedule.minute&(1<<next.Minute()) == 0 || schedule.hour&(1<<next.Hour()) == 0 ||
+			schedule.month&(1<<int(next.Month())) == 0 || !schedule.matchesDay(next) {
+			t.Fatalf("next run %v does not match %q", next, spec)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+// Manage a running runner through its control socket, then exit
+// args are the action and its arguments, status, restart NAME or group restart|stop|start NAME,
+// and flags can come before or after them
+// With asJSON, status is printed as it comes from the runner instead of as a table
+func runCtl(path *string, args []string, asJSON *bool) {
+	// The flag package stops at the first argument that is not a flag, so parse what follows each one too
+	var words []string
+	for {
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			break
+		}
+
+		words = append(words, args[0])
+		args = args[1:]
+	}
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: lars-script-runner ctl [flags] status|restart NAME|group restart|stop|start NAME")
+		os.Exit(1)
+	}
+	if len(words) == 0 {
+		usage()
+	}
+
+	var err error
+	switch action := words[0]; {
+	case action == "status" && len(words) == 1:
+		err = ctlStatus(*path, *asJSON)
+	case action == "restart" && len(words) == 2:
+		_, err = controlRequest(*path, http.MethodPost, controlAPIPrefix+"processes/"+url.PathEscape(words[1])+"/restart")
+		if err == nil {
+			fmt.Printf("restarted %s\n", words[1])
+		}
+	case action == "group" && len(words) == 3 && (words[1] == "restart" || words[1] == "stop" || words[1] == "start"):
+		_, err = controlRequest(*path, http.MethodPost, controlAPIPrefix+"groups/"+url.PathEscape(words[2])+"/"+words[1])
+		if err == nil {
+			fmt.Printf("%s group %s\n", map[string]string{"restart": "restarted", "stop": "stopped", "start": "started"}[words[1]], words[2])
+		}
+	default:
+		usage()
+	}
+
+	if err != nil {
+		slog.Error("ctl_failed", "socket", *path, "action", words[0], "error", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// Print the status of every process as a table, or the whole snapshot as JSON
+func ctlStatus(path string, asJSON bool) error {
+	body, err := controlRequest(path, http.MethodGet, controlAPIPrefix+"status")
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	var snapshot statusSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROCESS\tSTATE\tPID\tSTARTS\tFAILURES\tLAST EXIT")
+	for _, p := range snapshot.Processes {
+		pid := "-"
+		if p.Pid != 0 {
+			pid = fmt.Sprint(p.Pid)
+		}
+
+		lastExit := "-"
+		if p.ExitReason != "" {
+			lastExit = fmt.Sprintf("%s (%d)", p.ExitReason, *p.ExitCode)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", p.Name, p.State, pid, p.Starts, p.Failures, lastExit)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Code pages for bytes 0x80 to 0xFF, the lower half is plain ASCII
+// These are the OEM code pages used by most Windows consoles in the US and western Europe
+var codePages = map[string]*[128]rune{
+	"cp437": &cp437,
+	"cp850": &cp850,
+}
+
+var cp437 = [128]rune{
+	'\u00C7', '\u00FC', '\u00E9', '\u00E2', '\u00E4', '\u00E0', '\u00E5', '\u00E7',
+	'\u00EA', '\u00EB', '\u00E8', '\u00EF', '\u00EE', '\u00EC', '\u00C4', '\u00C5',
+	'\u00C9', '\u00E6', '\u00C6', '\u00F4', '\u00F6', '\u00F2', '\u00FB', '\u00F9',
+	'\u00FF', '\u00D6', '\u00DC', '\u00A2', '\u00A3', '\u00A5', '\u20A7', '\u0192',
+	'\u00E1', '\u00ED', '\u00F3', '\u00FA', '\u00F1', '\u00D1', '\u00AA', '\u00BA',
+	'\u00BF', '\u2310', '\u00AC', '\u00BD', '\u00BC', '\u00A1', '\u00AB', '\u00BB',
+	'\u2591', '\u2592', '\u2593', '\u2502', '\u2524', '\u2561', '\u2562', '\u2556',
+	'\u2555', '\u2563', '\u2551', '\u2557', '\u255D', '\u255C', '\u255B', '\u2510',
+	'\u2514', '\u2534', '\u252C', '\u251C', '\u2500', '\u253C', '\u255E', '\u255F',
+	'\u255A', '\u2554', '\u2569', '\u2566', '\u2560', '\u2550', '\u256C', '\u2567',
+	'\u2568', '\u2564', '\u2565', '\u2559', '\u2558', '\u2552', '\u2553', '\u256B',
+	'\u256A', '\u2518', '\u250C', '\u2588', '\u2584', '\u258C', '\u2590', '\u2580',
+	'\u03B1', '\u00DF', '\u0393', '\u03C0', '\u03A3', '\u03C3', '\u00B5', '\u03C4',
+	'\u03A6', '\u0398', '\u03A9', '\u03B4', '\u221E', '\u03C6', '\u03B5', '\u2229',
+	'\u2261', '\u00B1', '\u2265', '\u2264', '\u2320', '\u2321', '\u00F7', '\u2248',
+	'\u00B0', '\u2219', '\u00B7', '\u221A', '\u207F', '\u00B2', '\u25A0', '\u00A0',
+}
+
+var cp850 = [128]rune{
+	'\u00C7', '\u00FC', '\u00E9', '\u00E2', '\u00E4', '\u00E0', '\u00E5', '\u00E7',
+	'\u00EA', '\u00EB', '\u00E8', '\u00EF', '\u00EE', '\u00EC', '\u00C4', '\u00C5',
+	'\u00C9', '\u00E6', '\u00C6', '\u00F4', '\u00F6', '\u00F2', '\u00FB', '\u00F9',
+	'\u00FF', '\u00D6', '\u00DC', '\u00F8', '\u00A3', '\u00D8', '\u00D7', '\u0192',
+	'\u00E1', '\u00ED', '\u00F3', '\u00FA', '\u00F1', '\u00D1', '\u00AA', '\u00BA',
+	'\u00BF', '\u00AE', '\u00AC', '\u00BD', '\u00BC', '\u00A1', '\u00AB', '\u00BB',
+	'\u2591', '\u2592', '\u2593', '\u2502', '\u2524', '\u00C1', '\u00C2', '\u00C0',
+	'\u00A9', '\u2563', '\u2551', '\u2557', '\u255D', '\u00A2', '\u00A5', '\u2510',
+	'\u2514', '\u2534', '\u252C', '\u251C', '\u2500', '\u253C', '\u00E3', '\u00C3',
+	'\u255A', '\u2554', '\u2569', '\u2566', '\u2560', '\u2550', '\u256C', '\u00A4',
+	'\u00F0', '\u00D0', '\u00CA', '\u00CB', '\u00C8', '\u0131', '\u00CD', '\u00CE',
+	'\u00CF', '\u2518', '\u250C', '\u2588', '\u2584', '\u00A6', '\u00CC', '\u2580',
+	'\u00D3', '\u00DF', '\u00D4', '\u00D2', '\u00F5', '\u00D5', '\u00B5', '\u00FE',
+	'\u00DE', '\u00DA', '\u00DB', '\u00D9', '\u00FD', '\u00DD', '\u00AF', '\u00B4',
+	'\u00AD', '\u00B1', '\u2017', '\u00BE', '\u00B6', '\u00A7', '\u00F7', '\u00B8',
+	'\u00B0', '\u00A8', '\u00B7', '\u00B9', '\u00B3', '\u00B2', '\u25A0', '\u00A0',
+}
+
+// Check whether an output encoding is known
+func validOutputEncoding(encoding string) bool {
+	switch encoding {
+	case "utf8", "utf16le", "auto":
+		return true
+	}
+
+	return codePages[encoding] != nil
+}
+
+// Writer that converts child output to UTF-8 before passing it on
+// With "auto" the encoding is guessed from the first write: UTF-16 if it
+// looks like UTF-16, otherwise UTF-8 where valid and cp850 for bytes that are not
+// A character split over two writes is held back until the rest of it arrives
+type decodingWriter struct {
+	dest     io.Writer
+	encoding string
+	pending  []byte
+}
+
+func (w *decodingWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+	w.pending = nil
+
+	if w.encoding == "auto" {
+		w.encoding = guessEncoding(data)
+	}
+
+	var out []byte
+	switch w.encoding {
+	case "utf16le":
+		out, w.pending = decodeUTF16LE(data)
+	case "utf8-or-oem":
+		out, w.pending = decodeUTF8OrCodePage(data, &cp850)
+	default:
+		out = decodeCodePage(data, codePages[w.encoding])
+	}
+
+	if _, err := w.dest.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Write out bytes held back at the end of the output
+// They can not be completed any more, so they are decoded with the code page
+func (w *decodingWriter) flush() {
+	if len(w.pending) > 0 {
+		w.dest.Write(decodeCodePage(w.pending, &cp850))
+		w.pending = nil
+	}
+}
+
+// Guess the encoding of child output from the first bytes written
+func guessEncoding(data []byte) string {
+	// A byte order mark, or ASCII text with every other byte zero
+	if len(data) >= 2 && ((data[0] == 0xFF && data[1] == 0xFE) || (data[0] != 0 && data[1] == 0)) {
+		return "utf16le"
+	}
+
+	return "utf8-or-oem"
+}
+
+// Decode UTF-16LE, returning any trailing bytes that do not form a full character yet
+func decodeUTF16LE(data []byte) ([]byte, []byte) {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])|uint16(data[i+1])<<8)
+	}
+
+	rest := data[len(units)*2:]
+
+	// Keep a high surrogate until the low surrogate that completes it arrives
+	if n := len(units); n > 0 && utf16.IsSurrogate(rune(units[n-1])) && units[n-1] < 0xDC00 {
+		units = units[:n-1]
+		rest = data[len(units)*2:]
+	}
+
+	var out []byte
+	for _, r := range utf16.Decode(units) {
+		// Drop the byte order mark
+		if r != '\uFEFF' {
+			out = utf8.AppendRune(out, r)
+		}
+	}
+
+	return out, append([]byte(nil), rest...)
+}
+
+// Decode a single byte code page
+func decodeCodePage(data []byte, page *[128]rune) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b < 0x80 {
+			out = append(out, b)
+		} else {
+			out = utf8.AppendRune(out, page[b-0x80])
+		}
+	}
+
+	return out
+}
+
+// Pass valid UTF-8 through and decode anything else with a code page, a byte at a time
+// so one stray byte does not garble the valid characters around it
+// Returns any trailing bytes that could be the start of an incomplete UTF-8 character
+func decodeUTF8OrCodePage(data []byte, page *[128]rune) ([]byte, []byte) {
+	// Hold back a possibly incomplete character at the end
+	var rest []byte
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				rest = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+
+	if utf8.Valid(data) {
+		return data, rest
+	}
+
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+
+		// Only bytes from 0x80 up can be invalid, ASCII always decodes
+		if r == utf8.RuneError && size == 1 {
+			out = utf8.AppendRune(out, page[data[0]-0x80])
+		} else {
+			out = append(out, data[:size]...)
+		}
+		data = data[size:]
+	}
+
+	return out, rest
+}
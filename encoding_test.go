@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Output is decoded the same however it is split into writes
+func TestDecodingWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		writes   []string
+		want     string
+	}{
+		{"utf8 passes through", "auto", []string{"héllo wörld\n"}, "héllo wörld\n"},
+		{"utf8 split in a character", "auto", []string{"h\xc3", "\xa9llo \xe2\x82", "\xac\n"}, "héllo €\n"},
+		{"stray byte among utf8", "auto", []string{"caf\xc3\xa9 \x82t\xe9\n"}, "café étÚ\n"},
+		{"cp850", "auto", []string{"\x82t\x82\n"}, "été\n"},
+		{"incomplete character at the end", "auto", []string{"ok \xc3"}, "ok ├"},
+		{"cp437", "cp437", []string{"\x82\xb0\n"}, "é░\n"},
+		{"utf16le with a byte order mark", "auto", []string{"\xff\xfeh\x00i\x00\n\x00"}, "hi\n"},
+		{"utf16le split in a surrogate pair", "utf16le", []string{"a\x00\x3d\xd8", "\x00\xde\n"}, "a😀\n"},
+		{"utf16le split in a unit", "utf16le", []string{"a\x00b", "\x00"}, "ab"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			w := &decodingWriter{dest: &out, encoding: test.encoding}
+
+			for _, p := range test.writes {
+				if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", p, n, err)
+				}
+			}
+			w.flush()
+
+			if out.String() != test.want {
+				t.Errorf("decoded %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	contents := "# comment\n\nPLAIN=value\nexport EXPORTED=yes\n  SPACED = padded  \nDOUBLE=\"a b\"\nSINGLE='c d'\nEMPTY=\nEQUALS=a=b\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := readEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"PLAIN=value", "EXPORTED=yes", "SPACED=padded", "DOUBLE=a b", "SINGLE=c d", "EMPTY=", "EQUALS=a=b"}
+	if !slices.Equal(env, want) {
+		t.Errorf("readEnvFile = %q, want %q", env, want)
+	}
+}
+
+func TestReadEnvFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	if err := os.WriteFile(path, []byte("GOOD=1\nno equals sign\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readEnvFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("readEnvFile error = %v, want one for line 2", err)
+	}
+
+	if _, err := readEnvFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Error("readEnvFile of a missing file did not fail")
+	}
+}
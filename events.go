@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// Version of the layout of the lines in the events file
+// Bump it when fields are renamed or their meaning changes, adding fields does not need a new version
+const eventsSchemaVersion = 1
+
+// Also write every event the runner logs to a file, as one JSON object per line
+// Each line has schema_version, ts, level and event fields followed by the attributes of the event
+func logEventsToFile(path string) {
+	// Append so events from earlier runs are kept
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+
+	// If the file could not be opened, exit the program
+	if err != nil {
+		slog.Error("failed_to_open", "file", path, "error", err)
+		os.Exit(1)
+	}
+
+	events := slog.NewJSONHandler(file, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch a.Key {
+				case slog.TimeKey:
+					a.Key = "ts"
+				case slog.MessageKey:
+					a.Key = "event"
+				}
+			}
+
+			return a
+		},
+	}).WithAttrs([]slog.Attr{slog.Int("schema_version", eventsSchemaVersion)})
+
+	addLogHandler(events)
+}
+
+// Also pass every event the runner logs on to another handler
+func addLogHandler(h slog.Handler) {
+	// SetDefault sends the log package's output to the new handler, which would loop back
+	// into the original handler, so the log package is pointed back at stderr afterwards
+	slog.SetDefault(slog.New(teeHandler{slog.Default().Handler(), h}))
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
+
+// Handler that passes every record on to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+
+	return handlers
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Why a process stopped running
+type exitReason struct {
+	// One of clean_exit, nonzero_exit, killed_externally, supervisor_terminated, timed_out or unknown
+	kind string
+
+	// Exit code, -1 if the process did not exit on its own
+	code int
+
+	// Name of the signal that killed the process, if any
+	signal string
+}
+
+// Work out why a process stopped running from its exit status
+// state is nil if the exit status could not be collected
+// stopRequested is true if the runner itself asked the process to stop
+// timedOut is true if the process was stopped for running longer than its maximum runtime
+func classifyExit(state *os.ProcessState, stopRequested bool, timedOut bool) exitReason {
+	reason := exitStatusReason(state)
+
+	if stopRequested {
+		reason.kind = "supervisor_terminated"
+	} else if timedOut {
+		reason.kind = "timed_out"
+	}
+
+	return reason
+}
+
+// Work out why a process stopped running from its exit status alone
+func exitStatusReason(state *os.ProcessState) exitReason {
+	if state == nil {
+		return exitReason{kind: "unknown", code: -1}
+	}
+
+	if state.Exited() {
+		if state.ExitCode() == 0 {
+			return exitReason{kind: "clean_exit"}
+		}
+
+		return exitReason{kind: "nonzero_exit", code: state.ExitCode()}
+	}
+
+	// The runner does not send signals unless it is stopping the process,
+	// so a signal here came from someone else
+	// Windows never reports signals, so this only applies elsewhere
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return exitReason{kind: "killed_externally", code: -1, signal: status.Signal().String()}
+	}
+
+	return exitReason{kind: "unknown", code: state.ExitCode()}
+}
+
+// Return the reason as key value pairs for logging
+func (r exitReason) logAttrs() []any {
+	attrs := []any{"exit_reason", r.kind, "exit_code", r.code}
+
+	if r.signal != "" {
+		attrs = append(attrs, "signal", r.signal)
+	}
+
+	return attrs
+}
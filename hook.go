@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Run the failure hook of the command and wait for it to finish
+// The hook gets the environment of the command plus FAILED_CMD, FAILED_PROCESS, EXIT_CODE and FAILURE_COUNT
+// If quit is closed while the hook is running, the hook is killed
+func (pm *processManager) runFailureHook(quit <-chan bool, last runResult, failures int) {
+	name := pm.cmd.name
+
+	// Exit code of the latest run, -1 if it could not be started
+	exitCode := -1
+	if last.started {
+		exitCode = last.reason.code
+	}
+
+	slog.Info("running_failure_hook", "process", name, "hook", pm.cmd.onFailure)
+
+	env, fileSecrets, err := pm.cmd.environment()
+	if err != nil {
+		slog.Warn("failure_hook_failed", "process", name, "error", pm.cmd.mask(err.Error()))
+		return
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+
+	// The hook line was checked when the configuration was loaded
+	args, _ := splitCommandLine(pm.cmd.onFailure, nil)
+
+	hook := exec.Command(args[0], args[1:]...)
+	hook.Dir = pm.cmd.dir
+	hook.Env = append(env,
+		"FAILED_CMD="+pm.cmd.mask(pm.cmd.line),
+		"FAILED_PROCESS="+name,
+		"EXIT_CODE="+strconv.Itoa(exitCode),
+		"FAILURE_COUNT="+strconv.Itoa(failures))
+
+	// The output of the hook is captured like that of the processes, under its own name
+	flushOutput := pm.sink.attach(hook, fmt.Sprintf("%s (on_failure)", name), append(fileSecrets, pm.cmd.secrets...))
+
+	if err := hook.Start(); err != nil {
+		slog.Warn("failure_hook_failed", "process", name, "error", err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-quit:
+			hook.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	err = hook.Wait()
+	close(done)
+	flushOutput()
+
+	if err != nil {
+		slog.Warn("failure_hook_failed", "process", name, "error", err)
+		return
+	}
+
+	slog.Info("failure_hook_finished", "process", name)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Check whether a file in a configuration directory is read, and whether it is a YAML configuration
+func commandFileKind(name string) (read bool, yaml bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt":
+		return true, false
+	case ".yaml", ".yml":
+		return true, true
+	}
+
+	return false, false
+}
+
+// Read commands from a command file, a YAML configuration or a directory of them
+// Files ending in .yaml or .yml are YAML configurations, anything else is a command file
+// Of a directory, only the *.txt, *.yaml and *.yml files are read, in name order
+// Command files can include other files and directories with "include path", where the path
+// may be a glob pattern and is relative to the directory of the including file
+// Process names must be unique across all files
+func readCommandPath(path string, defaults command, key []byte) ([]command, error) {
+	return readCommandsFrom(path, defaults, key, nil)
+}
+
+// Read commands from a path, including holds the files currently being read to catch include loops
+func readCommandsFrom(path string, defaults command, key []byte, including []string) ([]command, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if slices.Contains(including, absPath) {
+		return nil, fmt.Errorf("%s includes itself", path)
+	}
+	including = append(slices.Clip(including), absPath)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var commands []command
+		names := make(map[string]bool)
+
+		for _, entry := range entries {
+			if read, _ := commandFileKind(entry.Name()); entry.IsDir() || !read {
+				continue
+			}
+
+			more, err := readCommandsFrom(filepath.Join(path, entry.Name()), defaults, key, including)
+			if err != nil {
+				return nil, err
+			}
+
+			if commands, err = appendCommands(commands, names, more); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+
+		return commands, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var commands []command
+	if _, yaml := commandFileKind(path); yaml {
+		commands, err = parseConfig(file, defaults, key)
+	} else {
+		commands, err = parseCommands(file, defaults, func(pattern string) ([]command, error) {
+			return includeCommands(path, pattern, defaults, key, including)
+		})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return commands, nil
+}
+
+// Read the commands from all files matching an include pattern in the file at path
+func includeCommands(path string, pattern string, defaults command, key []byte, including []string) ([]command, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("include %q: %w", pattern, err)
+	}
+
+	// A missing file is more likely a mistake than an empty directory
+	if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[`) {
+		return nil, fmt.Errorf("include %q: no such file", pattern)
+	}
+
+	var commands []command
+	names := make(map[string]bool)
+
+	for _, match := range matches {
+		more, err := readCommandsFrom(match, defaults, key, including)
+		if err != nil {
+			return nil, err
+		}
+
+		if commands, err = appendCommands(commands, names, more); err != nil {
+			return nil, err
+		}
+	}
+
+	return commands, nil
+}
+
+// Add commands read from another file, process names must stay unique
+func appendCommands(commands []command, names map[string]bool, more []command) ([]command, error) {
+	for _, cmd := range more {
+		if names[cmd.name] {
+			return nil, fmt.Errorf("process name %q is used more than once", cmd.name)
+		}
+		names[cmd.name] = true
+	}
+
+	return append(commands, more...), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Write files below dir, creating directories as needed
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Names of commands, in order
+func commandNames(commands []command) []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+
+	return names
+}
+
+func TestReadCommandPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.txt":             "web: ./server\ninclude services/*.txt\n",
+		"services/a.txt":       "api: ./api\n",
+		"services/b.txt":       "worker: ./worker\n",
+		"services/ignored.md":  "not: read\n",
+		"conf.d/10-jobs.txt":   "jobs: ./jobs\n",
+		"conf.d/20-more.yaml":  "processes:\n  - name: cache\n    command: ./cache\n",
+		"conf.d/notes.md":      "not: read\n",
+		"conf.d/sub/other.txt": "nested: ./not-read\n",
+	})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{filepath.Join(dir, "main.txt"), []string{"web", "api", "worker"}},
+		{filepath.Join(dir, "conf.d"), []string{"jobs", "cache"}},
+	}
+
+	for _, test := range tests {
+		commands, err := readCommandPath(test.path, command{}, nil)
+		if err != nil {
+			t.Errorf("readCommandPath(%s) failed: %v", test.path, err)
+			continue
+		}
+
+		if names := commandNames(commands); !slices.Equal(names, test.want) {
+			t.Errorf("readCommandPath(%s) = %q, want %q", test.path, names, test.want)
+		}
+	}
+}
+
+func TestReadCommandPathErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"loop.txt":      "a: ./a\ninclude loop.txt\n",
+		"duplicate.txt": "web: ./server\ninclude other.txt\n",
+		"other.txt":     "web: ./other\n",
+		"missing.txt":   "include nowhere.txt\n",
+	})
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"loop.txt", "includes itself"},
+		{"duplicate.txt", "used more than once"},
+		{"missing.txt", "no such file"},
+	}
+
+	for _, test := range tests {
+		_, err := readCommandPath(filepath.Join(dir, test.file), command{}, nil)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("readCommandPath(%s) error = %v, want one about %q", test.file, err, test.want)
+		}
+	}
+}
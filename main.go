@@ -1,188 +1,679 @@
-// Tiny program to run multiple commands in parallel and restart them if they exit.
-// Created by Lars Bernhardsson during Christmas break, 2023.
-// License: MIT
-
-package main
-
-import (
-	"bufio"
-	"flag"
-	"log/slog"
-	"os"
-	"os/exec"
-	"os/signal"
-	"strings"
-	"sync"
-	"syscall"
-	"time"
-)
-
-// Main function
-// Loads commands from a file and starts a goroutine for each command
-// Each goroutine starts the command and waits for it to finish
-// If the command exits, it is restarted
-// The program can be terminated by sending an OS signal (SIGTERM, SIGINT)
-func main() {
-	// Either use commands.txt or a user specified file
-	filePath := flag.String("f", "commands.txt", "file containing commands to run")
-	flag.Parse()
-
-	// Create a wait group to wait for all goroutines to finish
-	var wg sync.WaitGroup
-
-	// Create a channel to listen for termination signals
-	sigCh := make(chan os.Signal, 1)
-
-	// Listen for SIGINT and SIGTERM
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
-	// Create a channel to tell all goroutines to exit
-	quitCh := make(chan bool)
-
-	// Start goroutines for each command
-	for _, cmd := range loadCommands(*filePath) {
-		// Add a goroutine to the wait group
-		wg.Add(1)
-
-		// Start the goroutine
-		go startProcess(cmd, &wg, quitCh)
-	}
-
-	// Wait for termination signals
-	switch <-sigCh {
-	case os.Interrupt:
-		slog.Info("signal_received", "signal", "os.Interrupt")
-	case syscall.SIGINT:
-		slog.Info("signal_received", "signal", "syscall.SIGINT")
-	case syscall.SIGTERM:
-		slog.Info("signal_received", "signal", "syscall.SIGTERM")
-	default:
-		slog.Warn("signal_received", "signal", "UNKNOWN")
-	}
-
-	// Tell all goroutines to exit
-	slog.Info("closing_quit_channel")
-	close(quitCh)
-
-	// Print a message that we are waiting for all goroutines to finish
-	slog.Info("waiting_goroutines_exit")
-
-	// Wait for all goroutines to finish
-	wg.Wait()
-
-	// Print a message that all goroutines have finished
-	slog.Info("all_goroutines_exited")
-
-	// Exit the program
-	os.Exit(0)
-}
-
-// Load commands from a file
-// Each line in the file is a command to run
-// Empty lines are ignored
-func loadCommands(filePath string) []string {
-	var commands []string
-
-	// Print a message that we are loading commands from the file
-	slog.Info("loading_commands", "file", filePath)
-
-	// Open the file
-	file, err := os.Open(filePath)
-
-	// If the file could not be opened, exit the program
-	if err != nil {
-		slog.Error("failed_to_open", "file", filePath, "error", err)
-		os.Exit(1)
-	}
-
-	// Close the file when the function ends
-	defer file.Close()
-
-	// Read the file line by line
-	scanner := bufio.NewScanner(file)
-
-	// For each line, add the command to the list of commands
-	for scanner.Scan() {
-		cmd := strings.TrimSpace(scanner.Text())
-
-		// Ignore empty lines and lines starting with #
-		if cmd != "" && !strings.HasPrefix(cmd, "#") {
-			commands = append(commands, cmd)
-		}
-	}
-
-	// If there was an error reading the file, exit the program
-	if err := scanner.Err(); err != nil {
-		slog.Error("failed_to_scan", "file", filePath, "error", err)
-		os.Exit(1)
-	}
-
-	// Print a message that the commands have been loaded from the file
-	slog.Info("commands_loaded", "file", filePath)
-
-	// Return the list of commands
-	return commands
-}
-
-func startProcess(cmd string, wg *sync.WaitGroup, quit <-chan bool) {
-	// Tell the wait group that this goroutine is done when the function ends
-	defer wg.Done()
-
-	// Split the command string into command and arguments
-	parts := strings.Fields(cmd)
-	command := parts[0]
-	args := parts[1:]
-
-	// Create a ticker to only allow one restart attempt per second
-	ticker := time.NewTicker(time.Second)
-
-	// Close the ticker when the function ends
-	defer ticker.Stop()
-
-	// Endless for loop to restart the command if it exits
-	// The loop can be exited by sending a value to the quit channel
-	// or if there are any errors starting the command
-	for {
-		// make sure we don't try to restart the command more than once per second
-		<-ticker.C
-
-		// Check if the goroutine is being told to exit.
-		select {
-		case <-quit:
-			slog.Info("exiting_goroutine", "process", cmd)
-			return
-		default:
-			// Print a message that we are starting the command
-			slog.Info("starting_process", "process", cmd)
-
-			// Create command execution instance
-			process := exec.Command(command, args...)
-
-			// Set the standard output and error to the same as the parent process
-			process.Stdout = os.Stdout
-			process.Stderr = os.Stderr
-
-			// Start the process
-			err := process.Start()
-
-			// If the process could not be started, exit the goroutine
-			if err != nil {
-				slog.Warn("process_failed", "process", cmd, "error", err)
-				return
-			}
-
-			// Print a message that the process was started
-			slog.Info("process_started", "process", cmd)
-
-			// Wait for the process to finish
-			err = process.Wait()
-
-			// If the process exited with or without an error, make a note of it before looping around to restart it
-			if err != nil {
-				slog.Warn("process_exited_error", "process", cmd, "error", err)
-			} else {
-				slog.Warn("process_exited_normal", "process", cmd)
-			}
-		}
-	}
-}
+// Tiny program to run multiple commands in parallel and restart them if they exit.
+// Created by Lars Bernhardsson during Christmas break, 2023.
+// License: MIT
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Main function
+// Loads commands from a file and starts a goroutine for each command
+// Each goroutine starts the command and waits for it to finish
+// If the command exits, it is restarted
+// The program can be terminated by sending an OS signal (SIGTERM, SIGINT)
+func main() {
+	// The subcommand says what to do, the rest of the arguments are its flags
+	subcommand, args := parseSubcommand(os.Args[1:])
+	setSubcommandUsage(subcommand)
+
+	// Either use commands.txt or a user specified file
+	filePath := flag.String("f", "commands.txt", "file containing commands to run")
+	configPath := flag.String("config", "", "YAML file with commands and per-process settings, used instead of -f")
+	restartPolicy := flag.String("restart", restartAlways, "when to restart processes that exit, unless configured per process: always, on-failure or never")
+	onFailure := flag.String("on-failure", "", "command to run when a process is given up on, unless configured per process")
+	expandEnv := flag.Bool("expand-env", false, "replace $NAME and ${NAME} in command lines with environment variables")
+	eventsFile := flag.String("events-file", "", "file to also write every event the runner logs to, as JSON lines")
+	showVersion := flag.Bool("version", false, "print version and build information as JSON, then exit")
+	envLabel := flag.String("env", "", "environment label to report, e.g. prod or staging")
+	benchStartup := flag.Int("bench-startup", 0, "start this many dummy processes, report startup time and memory, then exit")
+	benchChild := flag.Bool("bench-child", false, "run as a dummy process for -bench-startup (used internally)")
+	outputFormat := flag.String("output-format", "text", "format of captured process output: text or json")
+	outputFile := flag.String("output-file", "", "file to write captured process output to instead of stdout/stderr")
+	stdoutDest := flag.String("stdout", "", "destination for process stdout: console, discard or a file (overrides -output-file)")
+	stderrDest := flag.String("stderr", "", "destination for process stderr: console, discard or a file (overrides -output-file)")
+	outputBuffer := flag.Int("output-buffer", 0, "number of writes to queue per output destination, 0 to write directly")
+	outputDrop := flag.String("output-drop", "block", "what to do when the output queue is full: block or drop-oldest")
+	outputEncoding := flag.String("output-encoding", "utf8", "encoding of process output to convert to UTF-8: utf8, cp437, cp850, utf16le or auto")
+	audit := flag.Bool("audit", false, "log the file descriptors, inherited environment variables and umask of every process after it starts (needs /proc)")
+	stagger := flag.Duration("stagger", 0, "delay between starting one process and the next when the runner starts")
+	grace := flag.Duration("grace", 10*time.Second, "time a process gets to exit after SIGTERM before it is killed, unless configured per process")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 0, "time to wait for all processes to stop on shutdown, 0 for twice the grace period")
+	watchConfig := flag.Bool("watch-config", false, "reload the command or config file when it changes, like on SIGHUP")
+	watchInterval := flag.Duration("watch-interval", 10*time.Second, "how often to check the files given with -watch")
+	certInterval := flag.Duration("cert-interval", 24*time.Hour, "how often to check the certificates given with -cert")
+	certWarnDays := flag.Int("cert-warn-days", 14, "warn when a certificate given with -cert expires within this many days")
+	secretKeyFile := flag.String("secret-key-file", "", "file with the base64 key for ENC[...] values in the YAML config, instead of $"+secretKeyEnv)
+	encrypt := flag.Bool("encrypt", false, "encrypt a value read from stdin for use in the YAML config, then exit")
+	multiline := flag.String("multiline", "", "regular expression for lines that continue the previous line in json output, e.g. ^\\s")
+	var watchPaths stringList
+	flag.Var(&watchPaths, "watch", "file to watch and report changes of without restarting anything, can be repeated")
+	var certSources stringList
+	flag.Var(&certSources, "cert", "certificate file or host:port to check for expiry, can be repeated")
+	controlPath := flag.String("control", "", "Unix domain socket to serve the control interface on, or to ask for the status with the status subcommand")
+	ctlJSON := flag.Bool("json", false, "print the status as JSON instead of a table with the ctl subcommand")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OpenTelemetry collector to send events and process metrics to with OTLP over HTTP, e.g. http://localhost:4318")
+	otlpInterval := flag.Duration("otlp-interval", 10*time.Second, "how often to send events and process metrics to the -otlp-endpoint")
+	var otlpHeaders stringList
+	flag.Var(&otlpHeaders, "otlp-header", "header to send to the -otlp-endpoint, like Authorization=Bearer abc, can be repeated")
+	var resourceCapacities stringList
+	flag.Var(&resourceCapacities, "resource", "number of slots of a resource processes can need, like gpu=2, can be repeated (resources not given have 1 slot)")
+	statusInterval := flag.Duration("status-interval", 30*time.Second, "how often to write a status snapshot to the destinations given with -status")
+	summaryFile := flag.String("summary-file", "", "file to write a JSON summary of all processes to on shutdown")
+	var statusDestinations stringList
+	flag.Var(&statusDestinations, "status", "file or http(s) URL to write a JSON status snapshot of all processes to, can be repeated")
+	flag.CommandLine.Parse(args)
+
+	// Act as one of the dummy processes started by -bench-startup
+	if *benchChild {
+		runBenchChild()
+	}
+
+	// Tell tooling what this runner is instead of running anything
+	if *showVersion || subcommand == "version" {
+		printVersion()
+	}
+
+	// Ask a running runner for its status instead of running anything
+	if subcommand == "status" {
+		runStatus(*controlPath)
+	}
+
+	// Manage a running runner instead of running anything
+	if subcommand == "ctl" {
+		runCtl(controlPath, flag.Args(), ctlJSON)
+	}
+
+	// validate only checks the configuration, so it neither announces itself nor sends its events anywhere
+	validating := subcommand == "validate"
+
+	// Keep a machine readable copy of all events
+	if *eventsFile != "" && !validating {
+		logEventsToFile(*eventsFile)
+	}
+
+	// Send events to an OpenTelemetry collector, process metrics follow once the processes are started
+	var otlp *otlpExporter
+	if *otlpEndpoint != "" && !validating {
+		if *otlpInterval <= 0 {
+			slog.Error("invalid_otlp_interval", "interval", *otlpInterval)
+			os.Exit(1)
+		}
+
+		headers := make(map[string]string)
+		for _, h := range otlpHeaders {
+			name, value, err := parseOTLPHeader(h)
+			if err != nil {
+				slog.Error("invalid_otlp_header", "error", err)
+				os.Exit(1)
+			}
+
+			headers[name] = value
+		}
+
+		otlp = newOTLPExporter(*otlpEndpoint, headers, *envLabel)
+		addLogHandler(otlpLogHandler{exporter: otlp})
+	}
+
+	// Load the key for encrypted configuration values
+	secretKey, err := loadSecretKey(*secretKeyFile)
+	if err != nil {
+		slog.Error("invalid_secret_key", "error", err)
+		os.Exit(1)
+	}
+
+	// Encrypt a value for the configuration instead of running anything
+	if *encrypt {
+		runEncrypt(secretKey)
+	}
+
+	// Print host level metadata so output from several runners can be told apart
+	if !validating {
+		logRunnerInfo(*envLabel)
+	}
+
+	// Send both streams to the output file unless a stream has its own destination
+	if *stdoutDest == "" {
+		*stdoutDest = *outputFile
+	}
+	if *stderrDest == "" {
+		*stderrDest = *outputFile
+	}
+
+	// Measure startup instead of running the commands
+	// validate must not start anything, so the benchmark is refused instead of run
+	if *benchStartup > 0 {
+		if validating {
+			slog.Error("invalid_subcommand_flag", "subcommand", subcommand, "flag", "bench-startup")
+			os.Exit(1)
+		}
+
+		runStartupBenchmark(*benchStartup)
+		os.Exit(0)
+	}
+
+	// Status snapshots are written every -status-interval, 0 would write them in a tight loop
+	if len(statusDestinations) > 0 && *statusInterval <= 0 {
+		slog.Error("invalid_status_interval", "interval", *statusInterval)
+		os.Exit(1)
+	}
+
+	// Watched files are checked every -watch-interval, which time.NewTicker does not accept unless it is positive
+	if (*watchConfig || len(watchPaths) > 0) && *watchInterval <= 0 {
+		slog.Error("invalid_watch_interval", "interval", *watchInterval)
+		os.Exit(1)
+	}
+
+	// Certificates are checked every -cert-interval, 0 would check them in a tight loop
+	if len(certSources) > 0 && *certInterval <= 0 {
+		slog.Error("invalid_cert_interval", "interval", *certInterval)
+		os.Exit(1)
+	}
+
+	// Slots of the resources processes can need
+	capacities := make(map[string]int)
+	for _, r := range resourceCapacities {
+		name, capacity, err := parseResourceCapacity(r)
+		if err != nil {
+			slog.Error("invalid_resource", "error", err)
+			os.Exit(1)
+		}
+
+		capacities[name] = capacity
+	}
+
+	// Settings for processes that do not configure their own
+	if !validRestartPolicy(*restartPolicy) {
+		slog.Error("invalid_restart_policy", "policy", *restartPolicy)
+		os.Exit(1)
+	}
+	defaults := command{
+		restartDelay: defaultRestartDelay,
+		restart:      *restartPolicy,
+		grace:        *grace,
+		expandEnv:    *expandEnv,
+		onFailure:    *onFailure,
+	}
+	if err := defaults.checkOnFailure(); err != nil {
+		slog.Error("invalid_on_failure", "error", err)
+		os.Exit(1)
+	}
+
+	// Load the commands and warn about any that can not be started
+	var commands []command
+	if *configPath != "" {
+		commands = loadConfig(*configPath, defaults, secretKey)
+	} else {
+		commands = loadCommands(*filePath, defaults, secretKey)
+	}
+
+	// Only check the commands and show their settings, without starting anything
+	if validating {
+		runValidate(commands)
+	}
+	checkCommands(commands)
+
+	// Create the destinations for the output of all processes
+	sink := newOutputSink(outputConfig{
+		format:     *outputFormat,
+		stdout:     *stdoutDest,
+		stderr:     *stderrDest,
+		multiline:  *multiline,
+		bufferSize: *outputBuffer,
+		dropPolicy: *outputDrop,
+		encoding:   *outputEncoding,
+	})
+
+	// Create a channel to listen for termination signals
+	sigCh := make(chan os.Signal, 1)
+
+	// Listen for SIGINT and SIGTERM, and SIGHUP to reload the configuration
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Read the commands again when the configuration is reloaded
+	// Unlike at startup, a broken file is only reported and the running processes are kept
+	watchedConfig := *filePath
+	load := func() ([]command, error) {
+		return readCommandPath(*filePath, defaults, secretKey)
+	}
+	if *configPath != "" {
+		watchedConfig = *configPath
+		load = func() ([]command, error) {
+			return readCommandFile(*configPath, func(r io.Reader) ([]command, error) {
+				return parseConfig(r, defaults, secretKey)
+			})
+		}
+	}
+
+	// Start goroutines for each command
+	sup := newSupervisor(sink, *stagger, *audit, newResourcePools(capacities))
+	sup.apply(commands)
+
+	// Reload the configuration when the file changes
+	configChanged := make(chan struct{}, 1)
+	if *watchConfig {
+		go superviseSubsystem("config_watcher", func() { watchConfigFile(watchedConfig, *watchInterval, configChanged) })
+	}
+
+	// Watch for hangs in the runner itself
+	var mainLoop heartbeat
+	go superviseSubsystem("watchdog", func() { runWatchdog(&mainLoop, sup.managers) })
+
+	// Report system clock jumps in the background
+	go superviseSubsystem("clock_watcher", watchClockJumps)
+
+	// Report changes to watched files in the background
+	if len(watchPaths) > 0 {
+		go superviseSubsystem("file_watcher", func() { watchFiles(watchPaths, *watchInterval) })
+	}
+
+	// Check certificate expiry in the background
+	if len(certSources) > 0 {
+		go superviseSubsystem("certificate_checker", func() { watchCertificates(certSources, *certInterval, *certWarnDays) })
+	}
+
+	// Write status snapshots in the background
+	snapshot := func() statusSnapshot { return takeStatusSnapshot(sup, *envLabel) }
+	if len(statusDestinations) > 0 {
+		go superviseSubsystem("status_publisher", func() {
+			publishStatusPeriodically(statusDestinations, *statusInterval, snapshot)
+		})
+	}
+
+	// Send events and process metrics to the OpenTelemetry collector in the background
+	if otlp != nil {
+		go superviseSubsystem("otlp_exporter", func() { otlp.run(*otlpInterval, snapshot) })
+	}
+
+	// Serve the control interface, reloads asked for through it are handled like changes to the config file
+	var controlListener net.Listener
+	processRequests := make(chan processRequest)
+	if *controlPath != "" {
+		controlListener, err = listenControl(*controlPath)
+		if err != nil {
+			slog.Error("failed_to_listen", "socket", *controlPath, "error", err)
+			os.Exit(1)
+		}
+
+		go superviseSubsystem("control", func() { serveControl(controlListener, snapshot, configChanged, processRequests) })
+	}
+
+	// Wait for termination signals, reloading the configuration in the meantime when asked to
+	// Reloads and control requests stop processes and wait for them, which may take up to the grace period and the kill
+	for waiting := true; waiting; {
+		mainLoop.idle()
+		select {
+		case <-configChanged:
+			mainLoop.working(longestGrace(sup.commands) * 2)
+			sup.reload(load)
+			continue
+		case req := <-processRequests:
+			mainLoop.working(longestGrace(sup.commands) * 2)
+			req.done <- sup.control(req)
+			continue
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGHUP:
+				slog.Info("signal_received", "signal", "syscall.SIGHUP")
+				mainLoop.working(longestGrace(sup.commands) * 2)
+				sup.reload(load)
+				continue
+			case os.Interrupt:
+				slog.Info("signal_received", "signal", "os.Interrupt")
+			case syscall.SIGINT:
+				slog.Info("signal_received", "signal", "syscall.SIGINT")
+			case syscall.SIGTERM:
+				slog.Info("signal_received", "signal", "syscall.SIGTERM")
+			default:
+				slog.Warn("signal_received", "signal", "UNKNOWN")
+			}
+		}
+
+		waiting = false
+	}
+
+	// Tell all goroutines to exit
+	slog.Info("closing_quit_channel")
+	sup.stopAll()
+
+	// Give processes that ignore SIGTERM time to be killed before giving up
+	if *shutdownTimeout <= 0 {
+		*shutdownTimeout = longestGrace(sup.commands) * 2
+	}
+
+	// Print a message that we are waiting for all goroutines to finish
+	slog.Info("waiting_goroutines_exit", "timeout", *shutdownTimeout)
+
+	// Wait for all goroutines to finish, but not longer than the shutdown timeout
+	done := make(chan struct{})
+	go func() {
+		sup.wg.Wait()
+		close(done)
+	}()
+
+	exitCode := 0
+	select {
+	case <-done:
+		// Print a message that all goroutines have finished
+		slog.Info("all_goroutines_exited")
+
+		// Write out any output still waiting in the queues
+		sink.close()
+	case <-time.After(*shutdownTimeout):
+		slog.Error("shutdown_timeout", "timeout", *shutdownTimeout)
+		exitCode = 1
+	}
+
+	// Stop taking control requests, this also removes the socket
+	if controlListener != nil {
+		controlListener.Close()
+	}
+
+	// Report background subsystems that had to be restarted
+	logDegradedSubsystems()
+
+	// Report how far each process got in shutting down and how it did over the whole run
+	final := snapshot()
+	for _, p := range final.Processes {
+		attrs := []any{"process", p.Name, "state", p.State, "killed", p.Killed,
+			"starts", p.Starts, "restarts", p.Restarts, "failures", p.Failures, "uptime_total", p.UptimeTotal}
+		if p.ExitReason != "" {
+			attrs = append(attrs, "last_exit_reason", p.ExitReason, "last_exit_code", *p.ExitCode)
+		}
+
+		slog.Info("shutdown_summary", attrs...)
+	}
+
+	// Leave a last snapshot that shows how everything ended
+	finalDestinations := statusDestinations
+	if *summaryFile != "" {
+		finalDestinations = append(finalDestinations, *summaryFile)
+	}
+	publishStatus(finalDestinations, final)
+	if otlp != nil {
+		otlp.export(final)
+	}
+
+	// Exit the program
+	os.Exit(exitCode)
+}
+
+// Log metadata about the host and this runner
+func logRunnerInfo(envLabel string) {
+	// Fall back to an empty host name if it can not be determined
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("failed_to_get_hostname", "error", err)
+	}
+
+	slog.Info("runner_started",
+		"host", hostname,
+		"os", runtime.GOOS,
+		"arch", runtime.GOARCH,
+		"version", runnerVersion(),
+		"env", envLabel)
+}
+
+// Return the module version embedded by the Go toolchain
+// Binaries installed with "go install ...@version" carry a real version,
+// local builds report "(devel)"
+func runnerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	return info.Main.Version
+}
+
+// Version and build information, printed by -version
+type versionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	CommitDate string `json:"commit_date"`
+	Modified   bool   `json:"modified"`
+	GoVersion  string `json:"go_version"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+}
+
+// Print version and build information as JSON and exit
+// The commit and its date are only known for binaries built from a git checkout,
+// Go does not record when a binary was built
+func printVersion() {
+	info := versionInfo{
+		Version:   runnerVersion(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.time":
+				info.CommitDate = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(info)
+
+	os.Exit(0)
+}
+
+// Matches Procfile style lines like "web: ./server -p 8080"
+var procfileLine = regexp.MustCompile(`^([A-Za-z0-9_.-]+):\s+(.*)$`)
+
+// Load commands from a command file, a YAML configuration or a directory of them, see readCommandPath
+// Each line in a command file is a command to run
+// Empty lines are ignored
+// defaults holds the settings used for every command
+// key decrypts encrypted values in YAML configurations, it may be nil if there are none
+func loadCommands(filePath string, defaults command, key []byte) []command {
+	// Print a message that we are loading commands from the file
+	slog.Info("loading_commands", "file", filePath)
+
+	// Read the commands from the file and any files it includes
+	commands, err := readCommandPath(filePath, defaults, key)
+
+	// If a file could not be opened or read, exit the program
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		slog.Error("failed_to_open", "file", pathErr.Path, "error", err)
+		os.Exit(1)
+	} else if err != nil {
+		slog.Error("failed_to_scan", "file", filePath, "error", err)
+		os.Exit(1)
+	}
+
+	// Print a message that the commands have been loaded from the file
+	slog.Info("commands_loaded", "file", filePath)
+
+	// Return the list of commands
+	return commands
+}
+
+// Read commands from a reader, one per line
+// Empty lines and lines starting with # are ignored
+// A line may start with a Procfile style "name:" to give the command a name,
+// otherwise the command line itself is used as the name
+// A command starting with @cron and a schedule is run on that schedule
+// A line "include pattern" adds the commands read by include, which may be nil to not allow includes
+// defaults holds the settings used for every command
+func parseCommands(r io.Reader, defaults command, include func(pattern string) ([]command, error)) ([]command, error) {
+	var commands []command
+	names := make(map[string]bool)
+
+	// Read line by line
+	scanner := bufio.NewScanner(r)
+
+	// For each line, add the command to the list of commands
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Ignore empty lines and lines starting with #
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Add the commands from other files
+		if pattern, found := strings.CutPrefix(line, "include "); found {
+			if include == nil {
+				return nil, errors.New("include is only supported in command files")
+			}
+
+			included, err := include(strings.TrimSpace(pattern))
+			if err != nil {
+				return nil, err
+			}
+
+			if commands, err = appendCommands(commands, names, included); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Commands without a name are known by their command line
+		cmd := defaults
+		cmd.name = line
+		cmd.line = line
+
+		if m := procfileLine.FindStringSubmatch(line); m != nil {
+			cmd.name = m[1]
+			cmd.line = strings.TrimSpace(m[2])
+
+			// A name alone does not say what to run
+			if cmd.line == "" {
+				return nil, fmt.Errorf("process %q has no command", cmd.name)
+			}
+
+			// Names must tell processes apart
+			if names[cmd.name] {
+				return nil, fmt.Errorf("process name %q is used more than once", cmd.name)
+			}
+		} else {
+			// The same command line can be run more than once, the copies are numbered to tell them apart
+			for n := 2; names[cmd.name]; n++ {
+				cmd.name = fmt.Sprintf("%s (%d)", line, n)
+			}
+		}
+		names[cmd.name] = true
+
+		// Lines starting with @cron run on a schedule instead of being kept running
+		spec, line, err := splitScheduledLine(cmd.line)
+		if err != nil {
+			return nil, fmt.Errorf("process %q: %w", cmd.name, err)
+		}
+
+		if spec != "" {
+			if cmd.schedule, err = parseCronSchedule(spec); err != nil {
+				return nil, fmt.Errorf("process %q: %w", cmd.name, err)
+			}
+
+			cmd.line = line
+		}
+
+		if err := cmd.splitLine(); err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	return commands, scanner.Err()
+}
+
+// Check that the executable of each command can be found and run
+// Problems are only logged, the commands are still started
+// so they come up once the problem has been fixed
+// Returns the number of commands with problems
+func checkCommands(commands []command) int {
+	problems := 0
+
+	for _, cmd := range commands {
+		if err := checkCommand(cmd); err != nil {
+			slog.Warn("command_check_failed", "process", cmd.name, "error", cmd.mask(err.Error()))
+			problems++
+		}
+	}
+
+	return problems
+}
+
+// Check that the environment file, executable and working directory of a command can be used
+// LookPath also verifies that the file is executable
+func checkCommand(cmd command) (err error) {
+	env, fileSecrets, err := cmd.environment()
+	if err != nil {
+		return err
+	}
+
+	// Values from the environment file end up in errors about a command line they were expanded into
+	defer func() {
+		if err != nil {
+			err = errors.New(maskSecrets(err.Error(), fileSecrets))
+		}
+	}()
+
+	args, err := cmd.runArgs(env)
+	if err != nil {
+		return err
+	}
+
+	if cmd.dir != "" {
+		info, err := os.Stat(cmd.dir)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("working directory %q is not a directory", cmd.dir)
+		}
+	}
+
+	// Relative paths to executables are relative to the working directory
+	executable := args[0]
+	if cmd.dir != "" && !filepath.IsAbs(executable) && strings.ContainsAny(executable, `/\`) {
+		executable = filepath.Join(cmd.dir, executable)
+	}
+
+	_, err = exec.LookPath(executable)
+	return err
+}
+
+// Return the longest grace period of all commands
+func longestGrace(commands []command) time.Duration {
+	var longest time.Duration
+
+	for _, cmd := range commands {
+		longest = max(longest, cmd.grace)
+	}
+
+	return longest
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as the child process for tests that supervise something,
+// LSR_TEST_CHILD says what it does: exit=N exits with code N, sleep sleeps until it is stopped
+// and hang sleeps and ignores SIGTERM, so it has to be killed
+func TestMain(m *testing.M) {
+	child := os.Getenv("LSR_TEST_CHILD")
+	switch {
+	case child == "":
+		os.Exit(m.Run())
+	case strings.HasPrefix(child, "exit="):
+		code, _ := strconv.Atoi(strings.TrimPrefix(child, "exit="))
+		os.Exit(code)
+	case child == "sleep" || child == "hang":
+		if child == "hang" {
+			signal.Ignore(syscall.SIGTERM)
+		}
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+
+	os.Exit(2)
+}
+
+// A command that runs the test binary as a child process, see TestMain
+func testCommand(name, child string) command {
+	return command{
+		name:          name,
+		line:          name,
+		args:          []string{os.Args[0]},
+		env:           []string{"LSR_TEST_CHILD=" + child},
+		restart:       restartAlways,
+		restartDelay:  time.Second,
+		grace:         time.Second,
+		attempts:      1,
+		attemptWindow: 10 * time.Second,
+	}
+}
+
+// An output sink that throws the output of the children away
+func testSink() *outputSink {
+	return newOutputSink(outputConfig{format: "text", stdout: "discard", stderr: "discard", dropPolicy: "block", encoding: "utf8"})
+}
+
+// Parsing any file contents must not panic, and every command returned
+// must have a name and an executable
+func FuzzParseCommands(f *testing.F) {
+	f.Add("powershell ./test1.ps1\n\n# comment\nnonexisting_command\n")
+	f.Add("  \t \n#\n   # indented comment\r\n")
+	f.Add("  cmd arg ")
+	f.Add("backup: @cron \"0 3 * * *\" ./backup.sh\n@cron @hourly ./rotate.sh\n@cron \"1 2\n")
+	f.Add(strings.Repeat("x", 70000))
+
+	f.Fuzz(func(t *testing.T, data string) {
+		commands, err := parseCommands(strings.NewReader(data), command{}, nil)
+		if err != nil {
+			return
+		}
+
+		for _, cmd := range commands {
+			if cmd.name == "" {
+				t.Fatalf("command %q has no name", cmd.line)
+			}
+
+			if len(cmd.args) == 0 || cmd.args[0] == "" {
+				t.Fatalf("command %q has no executable", cmd.line)
+			}
+
+			if strings.HasPrefix(cmd.line, "#") {
+				t.Fatalf("comment %q returned as a command", cmd.line)
+			}
+		}
+	})
+}
+
+// Values from the environment file are masked in errors about the command line they were expanded into
+func TestCheckCommandMasksEnvFile(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "app.env")
+	if err := os.WriteFile(envFile, []byte("TOOL=not-a-real-tool-s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := command{name: "tool", line: "$TOOL --version", envFile: envFile, expandEnv: true}
+	err := checkCommand(cmd)
+	if err == nil {
+		t.Fatal("checking a command that does not exist did not fail")
+	}
+
+	if strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), secretMask) {
+		t.Errorf("error %q does not mask the value from the environment file", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// How long a connection waits for an on-demand process to accept connections after it was started
+const onDemandStartTimeout = 30 * time.Second
+
+// Run the command only while it is being used
+// The runner listens on the listen address and starts the command when a connection comes in,
+// passing connections on to the upstream address the command itself listens on
+// Once there have been no connections for the idle timeout, the command is stopped until the next one
+func (pm *processManager) runOnDemand(quit <-chan bool) {
+	name := pm.cmd.name
+
+	listener, err := net.Listen("tcp", pm.cmd.listen)
+	if err != nil {
+		slog.Error("on_demand_listen_failed", "process", name, "listen", pm.cmd.listen, "error", err)
+		pm.fail(quit, runResult{}, 0)
+		return
+	}
+	defer listener.Close()
+
+	slog.Info("on_demand_listening", "process", name, "listen", listener.Addr().String(), "upstream", pm.cmd.upstream)
+	pm.setState(stateIdle)
+
+	// Hand connections to the loop below until the listener is closed
+	conns := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			select {
+			case conns <- conn:
+			case <-quit:
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	var (
+		// Number of connections being passed on
+		active int
+		closed = make(chan struct{})
+
+		// Closed to stop the current run, and closed once the run has ended, both nil while the command is not running
+		stop    chan bool
+		runDone chan struct{}
+
+		// Fires once the command has had no connections for the idle timeout
+		idle <-chan time.Time
+	)
+
+	for {
+		select {
+		case <-quit:
+			if stop != nil {
+				close(stop)
+				<-runDone
+			}
+
+			slog.Info("exiting_goroutine", "process", name)
+			pm.setState(stateStopped)
+			return
+		case conn := <-conns:
+			if stop == nil {
+				slog.Info("on_demand_starting", "process", name, "client", conn.RemoteAddr().String())
+				stop, runDone = make(chan bool), make(chan struct{})
+				go func(stop <-chan bool, runDone chan<- struct{}) {
+					// runOnce logs how the run ended
+					pm.runOnce(stop)
+					close(runDone)
+				}(stop, runDone)
+			}
+
+			active++
+			idle = nil
+			go pm.proxyOnDemand(conn, runDone, closed, quit)
+		case <-closed:
+			active--
+			if active == 0 && stop != nil {
+				idle = pm.clock.After(pm.cmd.idleTimeout)
+			}
+		case <-idle:
+			slog.Info("on_demand_idle", "process", name, "idle_timeout", pm.cmd.idleTimeout)
+			close(stop)
+			<-runDone
+			stop, runDone, idle = nil, nil, nil
+			pm.setState(stateIdle)
+		case <-runDone:
+			// The command exited by itself, the next connection starts it again
+			stop, runDone, idle = nil, nil, nil
+			pm.setState(stateIdle)
+		}
+	}
+}
+
+// Pass a connection on to the upstream address of the command, waiting for the command to accept connections first
+// closed is sent to once the connection is done
+func (pm *processManager) proxyOnDemand(client net.Conn, runDone <-chan struct{}, closed chan<- struct{}, quit <-chan bool) {
+	defer func() {
+		select {
+		case closed <- struct{}{}:
+		case <-quit:
+		}
+	}()
+	defer client.Close()
+
+	// A process that was just started needs a moment before it accepts connections
+	deadline := pm.clock.Now().Add(onDemandStartTimeout)
+	var upstream net.Conn
+	for {
+		var err error
+		upstream, err = net.DialTimeout("tcp", pm.cmd.upstream, time.Second)
+		if err == nil {
+			break
+		}
+
+		if pm.clock.Now().After(deadline) {
+			slog.Warn("on_demand_upstream_unavailable", "process", pm.cmd.name, "upstream", pm.cmd.upstream, "error", err)
+			return
+		}
+
+		select {
+		case <-runDone:
+			slog.Warn("on_demand_upstream_unavailable", "process", pm.cmd.name, "upstream", pm.cmd.upstream, "error", err)
+			return
+		case <-pm.clock.After(100 * time.Millisecond):
+		}
+	}
+	defer upstream.Close()
+
+	// Copy both ways, when the client is done sending the upstream is told so it can finish its answer
+	sent := make(chan struct{})
+	go func() {
+		io.Copy(upstream, client)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(sent)
+	}()
+
+	io.Copy(client, upstream)
+	client.Close()
+	upstream.Close()
+	<-sent
+}
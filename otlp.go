@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of log records kept for the next export, the oldest are dropped when the collector can not keep up
+const otlpMaxQueuedLogs = 10000
+
+// How long to wait for the collector to accept an export
+const otlpExportTimeout = 10 * time.Second
+
+// Sends the runner's events and process metrics to an OpenTelemetry collector with OTLP over HTTP
+// The JSON encoding of OTLP is used, so no OpenTelemetry libraries are needed
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+	client   http.Client
+
+	mu      sync.Mutex
+	logs    []otlpLogRecord
+	dropped int
+
+	// Whether the last export failed, so a collector that is down is only reported once
+	failing bool
+}
+
+// Create an exporter for a collector like http://localhost:4318
+// headers are sent with every export, for collectors that need an API key
+func newOTLPExporter(endpoint string, headers map[string]string, envLabel string) *otlpExporter {
+	hostname, _ := os.Hostname()
+
+	resource := otlpResource{Attributes: []otlpKeyValue{
+		otlpString("service.name", "lars-script-runner"),
+		otlpString("service.version", runnerVersion()),
+		otlpString("host.name", hostname),
+		otlpString("os.type", runtime.GOOS),
+	}}
+	if envLabel != "" {
+		resource.Attributes = append(resource.Attributes, otlpString("deployment.environment", envLabel))
+	}
+
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		headers:  headers,
+		resource: resource,
+		client:   http.Client{Timeout: otlpExportTimeout},
+	}
+}
+
+// Export the queued events and the process metrics every interval
+func (e *otlpExporter) run(interval time.Duration, snapshot func() statusSnapshot) {
+	for {
+		time.Sleep(interval)
+		e.export(snapshot())
+	}
+}
+
+// Send the queued events and the metrics of the snapshot to the collector
+func (e *otlpExporter) export(snapshot statusSnapshot) {
+	e.mu.Lock()
+	logs, dropped := e.logs, e.dropped
+	e.logs, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	scope := otlpScope{Name: "lars-script-runner", Version: runnerVersion()}
+
+	var errs []string
+	if len(logs) > 0 {
+		body := map[string]any{"resourceLogs": []any{map[string]any{
+			"resource":  e.resource,
+			"scopeLogs": []any{map[string]any{"scope": scope, "logRecords": logs}},
+		}}}
+
+		if err := e.post("/v1/logs", body); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	body := map[string]any{"resourceMetrics": []any{map[string]any{
+		"resource":     e.resource,
+		"scopeMetrics": []any{map[string]any{"scope": scope, "metrics": otlpProcessMetrics(snapshot)}},
+	}}}
+	if err := e.post("/v1/metrics", body); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// Logging here adds to the queue for the next export, which is fine as it is only done when something changes
+	e.mu.Lock()
+	wasFailing := e.failing
+	e.failing = len(errs) > 0
+	e.mu.Unlock()
+
+	switch {
+	case len(errs) > 0 && !wasFailing:
+		slog.Warn("otlp_export_failed", "endpoint", e.endpoint, "error", strings.Join(errs, "; "))
+	case len(errs) == 0 && wasFailing:
+		slog.Info("otlp_export_recovered", "endpoint", e.endpoint)
+	}
+	if dropped > 0 {
+		slog.Warn("otlp_logs_dropped", "endpoint", e.endpoint, "dropped", dropped)
+	}
+}
+
+// Send one export request to the collector
+func (e *otlpExporter) post(path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: unexpected response %s", path, resp.Status)
+	}
+
+	return nil
+}
+
+// Queue a log record for the next export
+func (e *otlpExporter) enqueue(record otlpLogRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.logs) >= otlpMaxQueuedLogs {
+		e.logs = e.logs[1:]
+		e.dropped++
+	}
+	e.logs = append(e.logs, record)
+}
+
+// The metrics of every process in a snapshot, with the process name as an attribute
+// Counts are cumulative sums from when the process manager was created, the rest are gauges
+func otlpProcessMetrics(snapshot statusSnapshot) []otlpMetric {
+	now := strconv.FormatInt(snapshot.Time.UnixNano(), 10)
+
+	type metric struct {
+		name, description, unit string
+		sum                     bool
+		value                   func(p processSnapshot) any
+	}
+	metrics := []metric{
+		{"lsr.process.up", "1 if the process is running", "1", false, func(p processSnapshot) any { return p.State == stateRunning }},
+		{"lsr.process.starts", "Number of times the process was started", "1", true, func(p processSnapshot) any { return p.Starts }},
+		{"lsr.process.restarts", "Number of times the process was restarted", "1", true, func(p processSnapshot) any { return p.Restarts }},
+		{"lsr.process.failures", "Number of failed runs in a row", "1", false, func(p processSnapshot) any { return p.Failures }},
+		{"lsr.process.uptime", "Time all runs of the process have been running", "s", true, func(p processSnapshot) any { return p.UptimeTotal.Seconds() }},
+	}
+
+	var result []otlpMetric
+	for _, m := range metrics {
+		points := []otlpDataPoint{}
+
+		for _, p := range snapshot.Processes {
+			point := otlpDataPoint{
+				Attributes:   []otlpKeyValue{otlpString("process.name", p.Name)},
+				TimeUnixNano: now,
+			}
+			if p.Group != "" {
+				point.Attributes = append(point.Attributes, otlpString("process.group", p.Group))
+			}
+
+			// A new start time tells the collector a count has started over
+			if m.sum {
+				point.StartTimeUnixNano = strconv.FormatInt(p.CountedSince.UnixNano(), 10)
+			}
+
+			switch v := m.value(p).(type) {
+			case bool:
+				point.AsInt = "0"
+				if v {
+					point.AsInt = "1"
+				}
+			case int:
+				point.AsInt = strconv.Itoa(v)
+			case float64:
+				point.AsDouble = &v
+			}
+
+			points = append(points, point)
+		}
+
+		metric := otlpMetric{Name: m.name, Description: m.description, Unit: m.unit}
+		if m.sum {
+			metric.Sum = &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		} else {
+			metric.Gauge = &otlpGauge{DataPoints: points}
+		}
+
+		result = append(result, metric)
+	}
+
+	return result
+}
+
+// Handler that turns the runner's events into OTLP log records
+type otlpLogHandler struct {
+	exporter *otlpExporter
+
+	// Attributes added with WithAttrs, and the prefix for keys from WithGroup
+	attrs  []otlpKeyValue
+	prefix string
+}
+
+func (h otlpLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h otlpLogHandler) Handle(_ context.Context, r slog.Record) error {
+	record := otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+		SeverityNumber: otlpSeverity(r.Level),
+		SeverityText:   r.Level.String(),
+		Body:           otlpAnyValue{StringValue: &r.Message},
+		Attributes:     append([]otlpKeyValue{}, h.attrs...),
+	}
+
+	r.Attrs(func(a slog.Attr) bool {
+		record.Attributes = appendOTLPAttr(record.Attributes, h.prefix, a)
+		return true
+	})
+
+	h.exporter.enqueue(record)
+	return nil
+}
+
+func (h otlpLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append([]otlpKeyValue(nil), h.attrs...)
+	for _, a := range attrs {
+		h.attrs = appendOTLPAttr(h.attrs, h.prefix, a)
+	}
+
+	return h
+}
+
+func (h otlpLogHandler) WithGroup(name string) slog.Handler {
+	h.prefix += name + "."
+	return h
+}
+
+// Map slog levels onto the OTLP severity numbers
+func otlpSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 17
+	case level >= slog.LevelWarn:
+		return 13
+	case level >= slog.LevelInfo:
+		return 9
+	default:
+		return 5
+	}
+}
+
+// Add an slog attribute as OTLP attributes, groups are flattened into dotted keys
+// Durations are given in nanoseconds like in the events file
+func appendOTLPAttr(attrs []otlpKeyValue, prefix string, a slog.Attr) []otlpKeyValue {
+	a.Value = a.Value.Resolve()
+	key := prefix + a.Key
+
+	var value otlpAnyValue
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		for _, member := range a.Value.Group() {
+			attrs = appendOTLPAttr(attrs, key+".", member)
+		}
+		return attrs
+	case slog.KindBool:
+		b := a.Value.Bool()
+		value.BoolValue = &b
+	case slog.KindInt64:
+		value.IntValue = strconv.FormatInt(a.Value.Int64(), 10)
+	case slog.KindUint64:
+		value.IntValue = strconv.FormatUint(a.Value.Uint64(), 10)
+	case slog.KindDuration:
+		value.IntValue = strconv.FormatInt(int64(a.Value.Duration()), 10)
+	case slog.KindFloat64:
+		f := a.Value.Float64()
+		value.DoubleValue = &f
+	case slog.KindTime:
+		s := a.Value.Time().Format(time.RFC3339Nano)
+		value.StringValue = &s
+	default:
+		s := a.Value.String()
+		value.StringValue = &s
+	}
+
+	return append(attrs, otlpKeyValue{Key: key, Value: value})
+}
+
+// Parse an -otlp-header flag like Authorization=Bearer abc into the name and value
+func parseOTLPHeader(s string) (string, string, error) {
+	name, value, found := strings.Cut(s, "=")
+	if !found || strings.TrimSpace(name) == "" {
+		return "", "", fmt.Errorf("header %q must look like name=value", s)
+	}
+
+	return strings.TrimSpace(name), value, nil
+}
+
+// Parts of the OTLP JSON encoding that the runner uses
+// 64 bit integers are written as strings, as the encoding asks for
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Unit        string     `json:"unit"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+// Aggregation temporality of sums that count from a fixed start time
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+// Create a string attribute
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
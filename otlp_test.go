@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An export sends the queued events to /v1/logs and the process metrics to /v1/metrics,
+// with starts and restarts as cumulative sums counted from when the process manager was created
+func TestOTLPExport(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string][]byte)
+	headers := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		headers[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	exporter := newOTLPExporter(server.URL+"/", map[string]string{"Authorization": "Bearer abc"}, "prod")
+	slog.New(otlpLogHandler{exporter: exporter}).Warn("process_exited_error", "process", "web", "exit_code", 3)
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	exporter.export(statusSnapshot{
+		Time: since.Add(time.Hour),
+		Processes: []processSnapshot{{
+			Name:         "web",
+			Group:        "frontend",
+			State:        stateRunning,
+			Starts:       3,
+			Restarts:     2,
+			UptimeTotal:  90 * time.Second,
+			CountedSince: since,
+		}},
+	})
+
+	if headers["/v1/logs"] != "Bearer abc" || headers["/v1/metrics"] != "Bearer abc" {
+		t.Errorf("Authorization headers = %q, want Bearer abc for both", headers)
+	}
+
+	var logs struct {
+		ResourceLogs []struct {
+			Resource  otlpResource `json:"resource"`
+			ScopeLogs []struct {
+				LogRecords []otlpLogRecord `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(bodies["/v1/logs"], &logs); err != nil {
+		t.Fatalf("decoding the logs: %v", err)
+	}
+
+	records := logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 1 || *records[0].Body.StringValue != "process_exited_error" || records[0].SeverityNumber != 13 {
+		t.Fatalf("log records = %+v, want the one warning", records)
+	}
+	if attrs := otlpAttributes(records[0].Attributes); attrs["process"] != "web" || attrs["exit_code"] != "3" {
+		t.Errorf("log attributes = %v, want process web and exit_code 3", attrs)
+	}
+	if attrs := otlpAttributes(logs.ResourceLogs[0].Resource.Attributes); attrs["service.name"] != "lars-script-runner" || attrs["deployment.environment"] != "prod" {
+		t.Errorf("resource attributes = %v", attrs)
+	}
+
+	var metrics struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []otlpMetric `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	if err := json.Unmarshal(bodies["/v1/metrics"], &metrics); err != nil {
+		t.Fatalf("decoding the metrics: %v", err)
+	}
+
+	byName := make(map[string]otlpMetric)
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+
+	up := byName["lsr.process.up"]
+	if up.Gauge == nil || up.Gauge.DataPoints[0].AsInt != "1" {
+		t.Errorf("lsr.process.up = %+v, want a gauge of 1", up)
+	}
+
+	for name, want := range map[string]string{"lsr.process.starts": "3", "lsr.process.restarts": "2"} {
+		sum := byName[name].Sum
+		if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != otlpCumulative {
+			t.Errorf("%s = %+v, want a cumulative monotonic sum", name, byName[name])
+			continue
+		}
+
+		point := sum.DataPoints[0]
+		if point.AsInt != want || point.StartTimeUnixNano != "1704067200000000000" || point.TimeUnixNano != "1704070800000000000" {
+			t.Errorf("%s data point = %+v, want %s counted from the start of 2024", name, point, want)
+		}
+	}
+
+	if uptime := byName["lsr.process.uptime"].Sum; uptime == nil || *uptime.DataPoints[0].AsDouble != 90 {
+		t.Errorf("lsr.process.uptime = %+v, want a sum of 90 seconds", byName["lsr.process.uptime"])
+	}
+
+	// Every data point of every metric is labelled with the process name and group and nothing else
+	for name, m := range byName {
+		var points []otlpDataPoint
+		if m.Gauge != nil {
+			points = m.Gauge.DataPoints
+		}
+		if m.Sum != nil {
+			points = m.Sum.DataPoints
+		}
+		if len(points) == 0 {
+			t.Errorf("%s has no data points", name)
+		}
+		for _, point := range points {
+			if attrs := otlpAttributes(point.Attributes); len(attrs) != 2 || attrs["process.name"] != "web" || attrs["process.group"] != "frontend" {
+				t.Errorf("%s attributes = %v, want only the process name and group", name, attrs)
+			}
+		}
+	}
+}
+
+// The string values of OTLP attributes by key, integers as their decimal string
+func otlpAttributes(attrs []otlpKeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, a := range attrs {
+		switch {
+		case a.Value.StringValue != nil:
+			values[a.Key] = *a.Value.StringValue
+		default:
+			values[a.Key] = a.Value.IntValue
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait for more continuation lines before a grouped entry is written
+const multilineTimeout = 500 * time.Millisecond
+
+// A single captured line of child output in JSON output mode
+type outputLine struct {
+	Time    time.Time `json:"ts"`
+	Process string    `json:"process"`
+	Stream  string    `json:"stream"`
+	Line    string    `json:"line"`
+}
+
+// Settings for capturing process output
+type outputConfig struct {
+	// Either "text" or "json"
+	format string
+
+	// Destinations for each stream, "console", "discard" or the path of a file to append to,
+	// an empty destination is the same as "console"
+	stdout string
+	stderr string
+
+	// If not empty, lines matching this regular expression are grouped with the line before them
+	multiline string
+
+	// Number of writes to queue per destination, 0 writes directly
+	bufferSize int
+
+	// What to do when the queue is full, "block" or "drop-oldest"
+	dropPolicy string
+
+	// Encoding of the output written by the processes, see validOutputEncoding
+	encoding string
+}
+
+// Shared destinations for the output of all child processes
+// In text mode output is passed through untouched,
+// in JSON mode every line is wrapped in an outputLine object
+type outputSink struct {
+	mu        sync.Mutex
+	format    string
+	stdout    io.Writer
+	stderr    io.Writer
+	multiline *regexp.Regexp
+	encoding  string
+	queues    []*queuedWriter
+}
+
+// Create the output sink
+func newOutputSink(cfg outputConfig) *outputSink {
+	if cfg.format != "text" && cfg.format != "json" {
+		slog.Error("invalid_output_format", "format", cfg.format)
+		os.Exit(1)
+	}
+
+	if cfg.dropPolicy != "block" && cfg.dropPolicy != "drop-oldest" {
+		slog.Error("invalid_drop_policy", "policy", cfg.dropPolicy)
+		os.Exit(1)
+	}
+
+	if !validOutputEncoding(cfg.encoding) {
+		slog.Error("invalid_output_encoding", "encoding", cfg.encoding)
+		os.Exit(1)
+	}
+
+	sink := &outputSink{format: cfg.format, encoding: cfg.encoding}
+
+	if cfg.multiline != "" {
+		pattern, err := regexp.Compile(cfg.multiline)
+
+		// If the pattern is not a valid regular expression, exit the program
+		if err != nil {
+			slog.Error("invalid_multiline_pattern", "pattern", cfg.multiline, "error", err)
+			os.Exit(1)
+		}
+
+		sink.multiline = pattern
+	}
+
+	sink.stdout = sink.queue(cfg, "stdout", openDestination(cfg.stdout, os.Stdout))
+
+	// Share the file if both streams go to the same one
+	if cfg.stderr == cfg.stdout && cfg.stdout != "" && cfg.stdout != "console" {
+		sink.stderr = sink.stdout
+	} else {
+		sink.stderr = sink.queue(cfg, "stderr", openDestination(cfg.stderr, os.Stderr))
+	}
+
+	return sink
+}
+
+// Put a queue in front of a destination if buffering is enabled
+func (s *outputSink) queue(cfg outputConfig, name string, dest io.Writer) io.Writer {
+	if cfg.bufferSize <= 0 || dest == io.Discard {
+		return dest
+	}
+
+	q := newQueuedWriter(name, dest, cfg.bufferSize, cfg.dropPolicy == "drop-oldest")
+	s.queues = append(s.queues, q)
+
+	return q
+}
+
+// Write out everything still queued
+// Must only be called once all processes have exited
+func (s *outputSink) close() {
+	for _, q := range s.queues {
+		q.close()
+	}
+}
+
+// Open the destination for one output stream
+func openDestination(dest string, console io.Writer) io.Writer {
+	switch dest {
+	case "", "console":
+		return console
+	case "discard":
+		return io.Discard
+	}
+
+	// Append to the file so output from earlier runs is kept
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+
+	// If the file could not be opened, exit the program
+	if err != nil {
+		slog.Error("failed_to_open", "file", dest, "error", err)
+		os.Exit(1)
+	}
+
+	return file
+}
+
+// Connect the output of a process to the sink
+// Any of the secrets found in the output is masked
+// Returns a function that must be called after the process has exited
+// to write out any final line that did not end with a newline
+func (s *outputSink) attach(process *exec.Cmd, name string, secrets []string) func() {
+	var stdout, stderr io.Writer = s.stdout, s.stderr
+
+	// Writers that hold back data, in the order they have to be flushed
+	var pending []flusher
+
+	if s.format == "json" {
+		stdoutLines := &lineWriter{sink: s, process: name, stream: "stdout"}
+		stderrLines := &lineWriter{sink: s, process: name, stream: "stderr"}
+		stdout, stderr = stdoutLines, stderrLines
+		pending = append(pending, stdoutLines, stderrLines)
+	}
+
+	if replacer := secretReplacer(secrets); replacer != nil {
+		stdoutMasker := &maskingWriter{dest: stdout, replacer: replacer}
+		stderrMasker := &maskingWriter{dest: stderr, replacer: replacer}
+		stdout, stderr = stdoutMasker, stderrMasker
+		pending = append([]flusher{stdoutMasker, stderrMasker}, pending...)
+	}
+
+	if s.encoding != "utf8" {
+		stdoutDecoder := &decodingWriter{dest: stdout, encoding: s.encoding}
+		stderrDecoder := &decodingWriter{dest: stderr, encoding: s.encoding}
+		stdout, stderr = stdoutDecoder, stderrDecoder
+		pending = append([]flusher{stdoutDecoder, stderrDecoder}, pending...)
+	}
+
+	process.Stdout = stdout
+	process.Stderr = stderr
+
+	return func() {
+		for _, w := range pending {
+			w.flush()
+		}
+	}
+}
+
+// Writer that holds back data until more arrives or it is flushed
+type flusher interface {
+	flush()
+}
+
+// Write a single line of child output as a JSON object
+func (s *outputSink) writeLine(ts time.Time, process string, stream string, line string) {
+	// Leave characters like < > & as they are, the output is not meant for HTML
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(outputLine{Time: ts, Process: process, Stream: stream, Line: line}); err != nil {
+		slog.Warn("failed_to_encode_output", "process", process, "error", err)
+		return
+	}
+
+	dest := s.stdout
+	if stream == "stderr" {
+		dest = s.stderr
+	}
+
+	// Keep lines from different processes from being interleaved
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := dest.Write(data.Bytes()); err != nil {
+		slog.Warn("failed_to_write_output", "process", process, "error", err)
+	}
+}
+
+// Writer that splits child output into lines and hands each line to the sink
+// When multiline grouping is enabled, continuation lines are collected into
+// an entry which is written once the next entry starts or no more lines arrive
+type lineWriter struct {
+	sink    *outputSink
+	process string
+	stream  string
+	mu      sync.Mutex
+	buf     []byte
+	entry   []string
+	started time.Time
+	timer   *time.Timer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	// Handle every complete line, keep the rest for the next write
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.handleLine(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Write a line, or add it to the current entry if multiline grouping is enabled
+func (w *lineWriter) handleLine(line string) {
+	if w.sink.multiline == nil {
+		w.sink.writeLine(time.Now(), w.process, w.stream, line)
+		return
+	}
+
+	if len(w.entry) > 0 && w.sink.multiline.MatchString(line) {
+		w.entry = append(w.entry, line)
+	} else {
+		w.writeEntry()
+		w.entry = []string{line}
+		w.started = time.Now()
+	}
+
+	// Write the entry if no further lines arrive in time
+	if w.timer == nil {
+		w.timer = time.AfterFunc(multilineTimeout, w.timeout)
+	} else {
+		w.timer.Reset(multilineTimeout)
+	}
+}
+
+// Write the current entry as a single line
+func (w *lineWriter) writeEntry() {
+	if len(w.entry) > 0 {
+		w.sink.writeLine(w.started, w.process, w.stream, strings.Join(w.entry, "\n"))
+		w.entry = nil
+	}
+}
+
+// Called when no more lines arrived for the current entry
+func (w *lineWriter) timeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writeEntry()
+}
+
+// Write whatever is left in the buffer and the current entry
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.handleLine(string(w.buf))
+		w.buf = nil
+	}
+
+	w.writeEntry()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Longest part of a line held back while waiting for its end, so a secret at the end is not split
+const maskingHoldLimit = 64 * 1024
+
+// Writer that replaces secrets in child output before passing it on
+// Output is passed on a line at a time, so a secret split over two writes is still found
+type maskingWriter struct {
+	dest     io.Writer
+	replacer *strings.Replacer
+	mu       sync.Mutex
+	buf      []byte
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	// Pass on everything up to the last newline, or everything if no newline comes for too long
+	end := bytes.LastIndexByte(w.buf, '\n') + 1
+	if len(w.buf) > maskingHoldLimit {
+		end = len(w.buf)
+	}
+
+	if end > 0 {
+		if _, err := io.WriteString(w.dest, w.replacer.Replace(string(w.buf[:end]))); err != nil {
+			return 0, err
+		}
+
+		w.buf = append(w.buf[:0], w.buf[end:]...)
+	}
+
+	return len(p), nil
+}
+
+// Pass on whatever is left in the buffer
+func (w *maskingWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		io.WriteString(w.dest, w.replacer.Replace(string(w.buf)))
+		w.buf = nil
+	}
+}
+
+// Writer that queues writes and performs them in the background
+// so a slow destination does not hold up the child processes
+// When the queue is full it either blocks or drops the oldest queued write
+type queuedWriter struct {
+	name       string
+	dest       io.Writer
+	ch         chan []byte
+	dropOldest bool
+	dropped    atomic.Int64
+	done       chan struct{}
+
+	// Held for reading while writing to ch, closed is set once ch is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Create a queued writer and start its background goroutine
+func newQueuedWriter(name string, dest io.Writer, size int, dropOldest bool) *queuedWriter {
+	q := &queuedWriter{
+		name:       name,
+		dest:       dest,
+		ch:         make(chan []byte, size),
+		dropOldest: dropOldest,
+		done:       make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+func (q *queuedWriter) Write(p []byte) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	// A process that left children behind can still write after the queue is closed,
+	// nothing else writes to the destination by then
+	if q.closed {
+		return q.dest.Write(p)
+	}
+
+	// The caller may reuse p once Write returns
+	data := append([]byte(nil), p...)
+
+	if !q.dropOldest {
+		q.ch <- data
+		return len(p), nil
+	}
+
+	// Make room by throwing away the oldest queued writes until this one fits
+	for {
+		select {
+		case q.ch <- data:
+			return len(p), nil
+		default:
+		}
+
+		select {
+		case <-q.ch:
+			q.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Write queued data to the destination until the queue is closed
+func (q *queuedWriter) run() {
+	defer close(q.done)
+
+	for data := range q.ch {
+		if _, err := q.dest.Write(data); err != nil {
+			slog.Warn("failed_to_write_output", "destination", q.name, "error", err)
+		}
+
+		// Report dropped writes once the destination has caught up
+		if len(q.ch) == 0 {
+			if n := q.dropped.Swap(0); n > 0 {
+				slog.Warn("output_dropped", "destination", q.name, "writes", n)
+			}
+		}
+	}
+}
+
+// Stop accepting writes and wait for the queue to drain
+func (q *queuedWriter) close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.ch)
+	q.mu.Unlock()
+
+	<-q.done
+}
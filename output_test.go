@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Secrets are masked in child output even when a write ends in the middle of one
+func TestMaskingWriter(t *testing.T) {
+	var out strings.Builder
+	w := &maskingWriter{dest: &out, replacer: secretReplacer([]string{"s3cret-token"})}
+
+	for _, p := range []string{"token is s3cr", "et-token\nand again s3cret", "-token"} {
+		w.Write([]byte(p))
+	}
+
+	if got, want := out.String(), "token is *****\n"; got != want {
+		t.Errorf("before flush = %q, want %q", got, want)
+	}
+
+	w.flush()
+	if got, want := out.String(), "token is *****\nand again *****"; got != want {
+		t.Errorf("after flush = %q, want %q", got, want)
+	}
+}
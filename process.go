@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// States a supervised process can be in
+const (
+	// The command has not been started yet, it may be waiting for its turn when starts are staggered
+	stateStarting = "starting"
+
+	// The command is running
+	stateRunning = "running"
+
+	// The command could not be started and is waiting to be tried again
+	stateStartFailed = "start_failed"
+
+	// The command has exited and is waiting to be restarted
+	stateExited = "exited"
+
+	// The command has been asked to terminate
+	stateTerminating = "terminating"
+
+	// The command did not terminate within the grace period and has been killed
+	stateKilling = "killing"
+
+	// The command failed or was started too often and will not be retried
+	stateFailed = "failed"
+
+	// The command is waiting for its next scheduled run
+	stateScheduled = "scheduled"
+
+	// The command is waiting for a slot of a resource it needs
+	stateWaiting = "waiting"
+
+	// The command is not running and is started when a connection comes in, see runOnDemand
+	stateIdle = "idle"
+
+	// The command has exited and its restart policy says not to start it again
+	stateFinished = "finished"
+
+	// Supervision of the command has ended
+	stateStopped = "stopped"
+)
+
+// Supervises a single command, restarting it whenever it exits
+type processManager struct {
+	cmd   command
+	sink  *outputSink
+	clock clock
+
+	// How long to wait before the first start, to stagger the starts of all processes
+	startDelay time.Duration
+
+	// Whether to log what every run has received from the runner, see auditProcess
+	audit bool
+
+	// The pools the command takes resource slots from
+	resources *resourcePools
+
+	// CPU time used by all runs of the command so far, only used by the run goroutine
+	cpuUserTotal   time.Duration
+	cpuSystemTotal time.Duration
+
+	mu     sync.Mutex
+	state  string
+	killed bool
+
+	// The current or latest run, for status snapshots
+	pid         int
+	incarnation string
+	starts      int
+	startedAt   time.Time
+	lastExit    *exitReason
+
+	// Number of failed runs in a row, kept up to date by the run goroutine for status snapshots
+	failures int
+
+	// When a scheduled command runs next, zero while it is running
+	nextRun time.Time
+
+	// Time all runs so far have been running
+	uptimeTotal time.Duration
+
+	// When the manager was created, the counts above start from here
+	created time.Time
+
+	// Shows the watchdog whether the run loop is making progress
+	heartbeat heartbeat
+}
+
+// Create a process manager for a command
+func newProcessManager(cmd command, sink *outputSink, clk clock) *processManager {
+	return &processManager{cmd: cmd, sink: sink, clock: clk, state: stateStarting, created: clk.Now()}
+}
+
+// Set the current state
+func (pm *processManager) setState(state string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.state = state
+}
+
+// Set the number of failed runs in a row
+func (pm *processManager) setFailures(failures int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.failures = failures
+}
+
+// Return the current state and whether the latest run had to be killed when it was stopped
+func (pm *processManager) status() (string, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.state, pm.killed
+}
+
+// Longest time to wait before restarting a command that keeps failing
+const maxRestartBackoff = 5 * time.Minute
+
+// Result of a single run of the command
+type runResult struct {
+	// Whether the process could be started at all
+	started bool
+
+	// Whether the process was stopped because the runner is shutting down
+	stopped bool
+
+	// Whether the run counts as successful, see command.succeeded
+	succeeded bool
+
+	// Identifies this run in the logs
+	incarnation string
+
+	// Why the process exited and how long it ran, only set if it was started
+	reason exitReason
+	uptime time.Duration
+}
+
+// Start the command and restart it whenever it exits, until quit is closed
+func (pm *processManager) run(wg *sync.WaitGroup, quit <-chan bool) {
+	// Tell the wait group that this goroutine is done when the function ends
+	defer wg.Done()
+
+	pm.heartbeat.working(0)
+	defer pm.heartbeat.idle()
+
+	name := pm.cmd.name
+
+	// Scheduled commands are not kept running
+	if pm.cmd.schedule != nil {
+		pm.runScheduled(quit)
+		return
+	}
+
+	// Neither are on-demand commands
+	if pm.cmd.listen != "" {
+		pm.runOnDemand(quit)
+		return
+	}
+
+	// Wait for this process's turn if starts are staggered
+	if pm.startDelay > 0 {
+		pm.heartbeat.idle()
+		select {
+		case <-quit:
+			slog.Info("exiting_goroutine", "process", name)
+			pm.setState(stateStopped)
+			return
+		case <-pm.clock.After(pm.startDelay):
+		}
+		pm.heartbeat.working(0)
+	}
+
+	// Number of failed runs in a row, both failed starts and unsuccessful exits count
+	failures := 0
+
+	// Times of the recent starts, to enforce the start limit
+	var starts []time.Time
+
+	// The latest run, reported to the failure hook
+	var result runResult
+
+	// Endless for loop to restart the command if it exits
+	// The loop can be exited by sending a value to the quit channel,
+	// if the restart policy says not to restart the command
+	// or if the command fails more often in a row than it may be retried
+	for {
+		// Check if the goroutine is being told to exit.
+		select {
+		case <-quit:
+			slog.Info("exiting_goroutine", "process", name)
+			pm.setState(stateStopped)
+			return
+		default:
+		}
+
+		// Give up if the command has been started too often within the start limit interval
+		if pm.cmd.startLimitBurst > 0 {
+			now := pm.clock.Now()
+			starts = slices.DeleteFunc(starts, func(t time.Time) bool {
+				return now.Sub(t) >= pm.cmd.startLimitInterval
+			})
+
+			if len(starts) >= pm.cmd.startLimitBurst {
+				slog.Warn("start_limit_hit", "process", name,
+					"starts", len(starts), "interval", pm.cmd.startLimitInterval)
+				pm.fail(quit, result, failures)
+				return
+			}
+
+			starts = append(starts, now)
+		}
+
+		result = pm.runOnce(quit)
+		pm.heartbeat.working(0)
+
+		// A process we stopped ourselves is neither a success nor a failure,
+		// loop around to notice the quit channel is closed
+		if result.stopped {
+			continue
+		}
+
+		// Leave the process down if its restart policy says so
+		if result.started && !pm.cmd.shouldRestart(result.reason) {
+			slog.Info("process_not_restarted", "process", name, "incarnation", result.incarnation,
+				"restart", pm.cmd.restart)
+			pm.setState(stateFinished)
+			return
+		}
+
+		// Restart after the restart delay, counted from when the run ended
+		delay := pm.cmd.restartDelay
+
+		// A run that stayed up for the minimum uptime clears earlier failures, even if it failed itself in the end
+		if pm.cmd.minUptime > 0 && result.uptime >= pm.cmd.minUptime {
+			failures = 0
+		}
+
+		// A run that ended before the minimum uptime counts as a failure however it exited
+		if result.succeeded && result.uptime >= pm.cmd.minUptime {
+			failures = 0
+			pm.setFailures(failures)
+		} else {
+			failures++
+			pm.setFailures(failures)
+
+			// Give up once out of retries, 0 retries means there is no limit
+			if pm.cmd.maxRetries > 0 && failures > pm.cmd.maxRetries {
+				slog.Warn("process_failed", "process", name, "incarnation", result.incarnation,
+					"failures", failures, "max_retries", pm.cmd.maxRetries)
+				pm.fail(quit, result, failures)
+				return
+			}
+
+			// Wait longer after every failure in a row so a broken command does not flood the logs
+			delay = pm.cmd.backoff(failures)
+			slog.Info("restart_backoff", "process", name, "incarnation", result.incarnation,
+				"failures", failures, "delay", delay)
+		}
+
+		pm.heartbeat.idle()
+		select {
+		case <-quit:
+		case <-pm.clock.After(delay):
+		}
+		pm.heartbeat.working(0)
+	}
+}
+
+// Give up on the command and run its failure hook, if it has one
+// last is the latest run and failures the number of failed runs in a row
+func (pm *processManager) fail(quit <-chan bool, last runResult, failures int) {
+	pm.setState(stateFailed)
+
+	// The hook is a command of its own that may take as long as it needs
+	if pm.cmd.onFailure != "" {
+		pm.heartbeat.idle()
+		pm.runFailureHook(quit, last, failures)
+	}
+}
+
+// Run the command on its schedule, until quit is closed
+// Runs that fail are not retried, the command just runs again at the next scheduled time
+func (pm *processManager) runScheduled(quit <-chan bool) {
+	name := pm.cmd.name
+
+	for {
+		pm.heartbeat.working(0)
+		next := pm.cmd.schedule.next(pm.clock.Now())
+		slog.Info("job_scheduled", "process", name, "next_run", next)
+		pm.mu.Lock()
+		pm.state = stateScheduled
+		pm.nextRun = next
+		pm.mu.Unlock()
+
+		// Wait in steps of at most a minute, so the run is not late if the system clock is set or the host was suspended
+		pm.heartbeat.idle()
+		for now := pm.clock.Now(); now.Before(next); now = pm.clock.Now() {
+			select {
+			case <-quit:
+				slog.Info("exiting_goroutine", "process", name)
+				pm.setState(stateStopped)
+				return
+			case <-pm.clock.After(min(next.Sub(now), time.Minute)):
+			}
+		}
+
+		// runOnce logs how the run ended
+		pm.heartbeat.working(0)
+		pm.mu.Lock()
+		pm.nextRun = time.Time{}
+		pm.mu.Unlock()
+		pm.runOnce(quit)
+	}
+}
+
+// Run the command once and wait for it to exit
+// If the command is allowed more than one attempt, quick failures are tried again as part of the same run
+// If quit is closed while the process is running, the process is stopped
+func (pm *processManager) runOnce(quit <-chan bool) runResult {
+	// Every run gets its own ID, so everything logged about one run can be found together
+	incarnation := newIncarnationID()
+
+	// On-demand commands run in a goroutine of their own, which must not look busy once the run is over
+	pm.heartbeat.working(0)
+	defer pm.heartbeat.idle()
+
+	for attempt := 1; ; attempt++ {
+		result := pm.runAttempt(quit, incarnation)
+
+		// Only retry processes that started and then failed within the attempt window,
+		// like scripts that give up straight away on a network hiccup
+		if result.stopped || result.succeeded || !result.started ||
+			attempt >= pm.cmd.attempts || result.uptime >= pm.cmd.attemptWindow {
+			return result
+		}
+
+		slog.Info("attempt_failed", "process", pm.cmd.name, "incarnation", incarnation,
+			"attempt", attempt, "attempts", pm.cmd.attempts)
+
+		// Do not start another attempt if the runner is shutting down
+		select {
+		case <-quit:
+			return result
+		default:
+		}
+	}
+}
+
+// Start the command once and wait for it to exit
+// If quit is closed while the process is running, the process is stopped
+func (pm *processManager) runAttempt(quit <-chan bool, incarnation string) runResult {
+	name := pm.cmd.name
+
+	// Wait for the resources the command needs, they are held until the process exits
+	resourceEnv, releaseResources, ok := pm.acquireResources(quit, incarnation)
+	if !ok {
+		return runResult{incarnation: incarnation, stopped: true}
+	}
+	defer releaseResources()
+
+	// Print a message that we are starting the command
+	slog.Info("starting_process", "process", name, "incarnation", incarnation, "command", pm.cmd.mask(pm.cmd.line))
+
+	// Create command execution instance with its environment and working directory
+	process, secrets, err := pm.cmd.newProcess(resourceEnv)
+
+	// Send the standard output and error to the output sink and start the process
+	var flushOutput func()
+	if err == nil {
+		flushOutput = pm.sink.attach(process, name, secrets)
+
+		// Children the process left running in the background keep its output open,
+		// only wait that long for them so they do not hold up the restart
+		// The grace period can be 0, which would mean waiting for ever
+		process.WaitDelay = max(pm.cmd.grace, time.Second)
+
+		err = process.Start()
+	}
+
+	// If the process could not be started, let the caller decide whether to try again
+	if err != nil {
+		slog.Warn("process_start_failed", "process", name, "incarnation", incarnation, "error", maskSecrets(err.Error(), secrets))
+		pm.setState(stateStartFailed)
+		return runResult{incarnation: incarnation}
+	}
+
+	// Print a message that the process was started
+	slog.Info("process_started", "process", name, "incarnation", incarnation)
+	started := pm.clock.Now()
+	pm.mu.Lock()
+	pm.state = stateRunning
+	pm.killed = false
+	pm.pid = process.Process.Pid
+	pm.incarnation = incarnation
+	pm.starts++
+	pm.startedAt = started
+	pm.mu.Unlock()
+
+	// Stop the process if the goroutine is told to exit while it is running,
+	// or if it runs longer than its maximum runtime
+	// Remember why it was stopped so the exit is not reported as external
+	var stopRequested, timedOut atomic.Bool
+	exited := make(chan struct{})
+
+	if pm.audit {
+		go pm.auditProcess(process.Process.Pid, incarnation, exited)
+	}
+	go func() {
+		// A nil channel never fires, so without a maximum runtime there is no timeout
+		var timeout <-chan time.Time
+		if pm.cmd.maxRuntime > 0 {
+			timeout = pm.clock.After(pm.cmd.maxRuntime)
+		}
+
+		select {
+		case <-quit:
+			stopRequested.Store(true)
+			pm.stop(process, incarnation, exited)
+		case <-timeout:
+			slog.Warn("max_runtime_exceeded", "process", name, "incarnation", incarnation, "max_runtime", pm.cmd.maxRuntime)
+			timedOut.Store(true)
+			pm.stop(process, incarnation, exited)
+		case <-exited:
+		}
+	}()
+
+	// Wait for the process to finish, however long it runs
+	pm.heartbeat.idle()
+	err = process.Wait()
+	pm.heartbeat.working(0)
+	uptime := pm.clock.Now().Sub(started)
+	close(exited)
+	pm.setState(stateExited)
+
+	// Write out any output that did not end with a newline
+	flushOutput()
+
+	// Add up the CPU time used by this run, if the exit status could be collected
+	var cpuUser, cpuSystem time.Duration
+	if process.ProcessState != nil {
+		cpuUser = process.ProcessState.UserTime()
+		cpuSystem = process.ProcessState.SystemTime()
+		pm.cpuUserTotal += cpuUser
+		pm.cpuSystemTotal += cpuSystem
+	}
+
+	// Describe how the process exited and what it used
+	result := runResult{
+		incarnation: incarnation,
+		started:     true,
+		stopped:     stopRequested.Load(),
+		reason:      classifyExit(process.ProcessState, stopRequested.Load(), timedOut.Load()),
+		uptime:      uptime,
+	}
+	result.succeeded = pm.cmd.succeeded(result.reason)
+
+	pm.mu.Lock()
+	pm.pid = 0
+	pm.lastExit = &result.reason
+	pm.uptimeTotal += uptime
+	pm.mu.Unlock()
+
+	attrs := []any{"process", name, "incarnation", incarnation}
+	attrs = append(attrs, result.reason.logAttrs()...)
+	attrs = append(attrs,
+		"uptime", uptime,
+		"cpu_user", cpuUser, "cpu_system", cpuSystem,
+		"cpu_user_total", pm.cpuUserTotal, "cpu_system_total", pm.cpuSystemTotal)
+
+	// Keep the error, if any, for exits that count as successful too
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+
+	// If the process exited with or without an error, make a note of it
+	// A process we stopped ourselves is expected to go away, so that is not a warning
+	if result.stopped {
+		slog.Info("process_stopped", attrs...)
+	} else if !result.succeeded {
+		slog.Warn("process_exited_error", attrs...)
+	} else {
+		slog.Warn("process_exited_normal", attrs...)
+	}
+
+	return result
+}
+
+// Stop a running process
+// It is first asked to terminate and killed if it has not exited when the grace period is over
+// exited is closed once the process has exited
+func (pm *processManager) stop(process *exec.Cmd, incarnation string, exited <-chan struct{}) {
+	slog.Info("stopping_process", "process", pm.cmd.name, "incarnation", incarnation, "grace", pm.cmd.grace)
+	pm.setState(stateTerminating)
+
+	// Windows can not deliver SIGTERM, so the process is killed there straight away
+	if err := process.Process.Signal(syscall.SIGTERM); err != nil {
+		pm.kill(process, incarnation)
+		return
+	}
+
+	select {
+	case <-exited:
+	case <-pm.clock.After(pm.cmd.grace):
+		slog.Warn("grace_period_expired", "process", pm.cmd.name, "incarnation", incarnation, "grace", pm.cmd.grace)
+		pm.kill(process, incarnation)
+	}
+}
+
+// Create a random ID for a run of a command
+func newIncarnationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Kill a running process
+func (pm *processManager) kill(process *exec.Cmd, incarnation string) {
+	pm.mu.Lock()
+	pm.state = stateKilling
+	pm.killed = true
+	pm.mu.Unlock()
+
+	if err := process.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		slog.Warn("failed_to_kill_process", "process", pm.cmd.name, "incarnation", incarnation, "error", err)
+	}
+}
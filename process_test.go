@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The restart policy, success exit codes, backoff, retries and minimum uptime decide
+// how often a command is started, how long is waited in between and how it ends up
+func TestProcessManagerRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		child string
+		setup func(cmd *command)
+
+		// How long every run seems to last, see fakeClock
+		uptime time.Duration
+
+		wantState  string
+		wantStarts int
+		wantWaits  []time.Duration
+	}{
+		{
+			name:       "never restarts",
+			child:      "exit=1",
+			setup:      func(cmd *command) { cmd.restart = restartNever },
+			wantState:  stateFinished,
+			wantStarts: 1,
+		},
+		{
+			name:       "on-failure does not restart a success",
+			child:      "exit=0",
+			setup:      func(cmd *command) { cmd.restart = restartOnFailure },
+			wantState:  stateFinished,
+			wantStarts: 1,
+		},
+		{
+			name:  "success exit codes are not failures",
+			child: "exit=3",
+			setup: func(cmd *command) {
+				cmd.restart = restartOnFailure
+				cmd.successCodes = []int{0, 3}
+			},
+			wantState:  stateFinished,
+			wantStarts: 1,
+		},
+		{
+			name:  "on-failure backs off until out of retries",
+			child: "exit=3",
+			setup: func(cmd *command) {
+				cmd.restart = restartOnFailure
+				cmd.maxRetries = 3
+			},
+			wantState:  stateFailed,
+			wantStarts: 4,
+			wantWaits:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:  "backoff is capped",
+			child: "exit=1",
+			setup: func(cmd *command) {
+				cmd.restartDelay = 2 * time.Minute
+				cmd.maxRetries = 4
+			},
+			wantState:  stateFailed,
+			wantStarts: 5,
+			wantWaits:  []time.Duration{2 * time.Minute, 4 * time.Minute, maxRestartBackoff, maxRestartBackoff},
+		},
+		{
+			name:  "always restarts successes until the start limit",
+			child: "exit=0",
+			setup: func(cmd *command) {
+				cmd.startLimitBurst = 3
+				cmd.startLimitInterval = time.Hour
+			},
+			wantState:  stateFailed,
+			wantStarts: 3,
+			wantWaits:  []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:  "runs shorter than min_uptime are failures",
+			child: "exit=0",
+			setup: func(cmd *command) {
+				cmd.minUptime = 10 * time.Second
+				cmd.maxRetries = 2
+			},
+			uptime:     time.Second,
+			wantState:  stateFailed,
+			wantStarts: 3,
+			wantWaits:  []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:  "runs longer than min_uptime clear earlier failures",
+			child: "exit=1",
+			setup: func(cmd *command) {
+				cmd.minUptime = 10 * time.Second
+				cmd.startLimitBurst = 3
+				cmd.startLimitInterval = time.Hour
+			},
+			uptime:     20 * time.Second,
+			wantState:  stateFailed,
+			wantStarts: 3,
+			wantWaits:  []time.Duration{time.Second, time.Second, time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := testCommand("test", test.child)
+			test.setup(&cmd)
+
+			clk := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), step: test.uptime}
+			pm := newProcessManager(cmd, testSink(), clk)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			pm.run(&wg, make(chan bool))
+
+			snapshot := pm.snapshot()
+			if snapshot.State != test.wantState {
+				t.Errorf("state = %q, want %q", snapshot.State, test.wantState)
+			}
+			if snapshot.Starts != test.wantStarts {
+				t.Errorf("starts = %d, want %d", snapshot.Starts, test.wantStarts)
+			}
+			if !slices.Equal(clk.waits, test.wantWaits) {
+				t.Errorf("waits = %v, want %v", clk.waits, test.wantWaits)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A process manager and the channels to stop it and see that it has stopped
+type supervised struct {
+	pm   *processManager
+	quit chan bool
+	done chan struct{}
+
+	// Makes stop safe to call more than once
+	stopOnce sync.Once
+}
+
+// Tell the process manager to stop, it may already have been told
+func (s *supervised) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+// Whether the process manager has ended, because it was stopped or gave up on the command
+func (s *supervised) ended() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Keeps a process manager running for every command, and changes which when the configuration is reloaded
+// Only changed from the main goroutine, mu is held for changes so other goroutines can call managers
+type supervisor struct {
+	sink      *outputSink
+	stagger   time.Duration
+	audit     bool
+	resources *resourcePools
+	wg        sync.WaitGroup
+
+	// The commands being supervised in the order they were configured, and their managers by name
+	mu       sync.Mutex
+	commands []command
+	running  map[string]*supervised
+}
+
+// Create a supervisor, nothing is started until apply is called
+func newSupervisor(sink *outputSink, stagger time.Duration, audit bool, resources *resourcePools) *supervisor {
+	return &supervisor{sink: sink, stagger: stagger, audit: audit, resources: resources, running: make(map[string]*supervised)}
+}
+
+// Start supervising a command
+func (s *supervisor) start(cmd command, startDelay time.Duration) {
+	pm := newProcessManager(cmd, s.sink, realClock{})
+	pm.startDelay = startDelay
+	pm.audit = s.audit
+	pm.resources = s.resources
+
+	sup := &supervised{pm: pm, quit: make(chan bool), done: make(chan struct{})}
+	s.mu.Lock()
+	s.running[cmd.name] = sup
+	s.mu.Unlock()
+
+	// Add a goroutine to the wait group
+	s.wg.Add(1)
+
+	// Start the goroutine
+	go func() {
+		pm.run(&s.wg, sup.quit)
+		close(sup.done)
+	}()
+}
+
+// Make the supervised processes match the commands
+// Processes that are new are started, those that are gone are stopped,
+// and those whose settings changed are stopped and then started again with the new settings
+// Processes that did not change are left alone
+func (s *supervisor) apply(commands []command) {
+	wanted := make(map[string]bool)
+	var stopping []*supervised
+	var starting []command
+	added, changed, removed, unchanged := 0, 0, 0, 0
+
+	for _, cmd := range commands {
+		wanted[cmd.name] = true
+
+		current, found := s.running[cmd.name]
+		switch {
+		case !found:
+			slog.Info("process_added", "process", cmd.name)
+			starting = append(starting, cmd)
+			added++
+		case !reflect.DeepEqual(current.pm.cmd, cmd):
+			slog.Info("process_changed", "process", cmd.name)
+			stopping = append(stopping, current)
+			starting = append(starting, cmd)
+			changed++
+		default:
+			unchanged++
+		}
+	}
+
+	for name, current := range s.running {
+		if !wanted[name] {
+			slog.Info("process_removed", "process", name)
+			stopping = append(stopping, current)
+			removed++
+		}
+	}
+
+	// Stop everything first and wait for it, so a changed process never runs twice at the same time
+	for _, sup := range stopping {
+		sup.stop()
+	}
+	for _, sup := range stopping {
+		<-sup.done
+
+		s.mu.Lock()
+		delete(s.running, sup.pm.cmd.name)
+		s.mu.Unlock()
+	}
+
+	for i, cmd := range starting {
+		s.start(cmd, time.Duration(i)*s.stagger)
+	}
+
+	s.mu.Lock()
+	s.commands = commands
+	s.mu.Unlock()
+
+	slog.Info("processes_applied", "added", added, "changed", changed, "removed", removed, "unchanged", unchanged)
+}
+
+// Read the commands again and apply them
+// If they can not be read, everything is left as it is
+func (s *supervisor) reload(load func() ([]command, error)) {
+	slog.Info("reloading_config")
+
+	commands, err := load()
+	if err != nil {
+		slog.Error("reload_failed", "error", err)
+		return
+	}
+
+	checkCommands(commands)
+	s.apply(commands)
+}
+
+// Restart, stop or start processes as asked for through the control socket
+// restart stops them and starts them again with the same settings, their restart backoff and start limit start over
+// like after a reload that changed them. stop keeps them stopped until they are started, restarted or changed by a reload,
+// and start starts those that are not being supervised anymore, leaving the others alone
+// All processes of a group are stopped before any is started again, so a group is restarted as a whole
+func (s *supervisor) control(req processRequest) error {
+	names := []string{req.name}
+	if req.group {
+		names = nil
+		for _, cmd := range s.commands {
+			if cmd.group == req.name {
+				names = append(names, cmd.name)
+			}
+		}
+
+		if len(names) == 0 {
+			return fmt.Errorf("no group named %q", req.name)
+		}
+	}
+
+	var targets []*supervised
+	for _, name := range names {
+		current, found := s.running[name]
+		if !found {
+			return fmt.Errorf("no process named %q", name)
+		}
+
+		targets = append(targets, current)
+	}
+
+	if req.action == "restart" || req.action == "stop" {
+		for _, sup := range targets {
+			if req.action == "restart" {
+				slog.Info("process_restarting", "process", sup.pm.cmd.name)
+			} else {
+				slog.Info("process_stopping", "process", sup.pm.cmd.name)
+			}
+			sup.stop()
+		}
+		for _, sup := range targets {
+			<-sup.done
+		}
+	}
+
+	if req.action == "restart" || req.action == "start" {
+		for _, sup := range targets {
+			if !sup.ended() {
+				continue
+			}
+
+			if req.action == "start" {
+				slog.Info("process_starting", "process", sup.pm.cmd.name)
+			}
+			s.start(sup.pm.cmd, 0)
+		}
+	}
+
+	return nil
+}
+
+// Tell all process managers to stop
+func (s *supervisor) stopAll() {
+	for _, sup := range s.running {
+		sup.stop()
+	}
+}
+
+// Return the managers of the supervised commands, in the order they were configured
+// While a reload is being applied, commands that are stopped but not started again yet are left out
+func (s *supervisor) managers() []*processManager {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var managers []*processManager
+	for _, cmd := range s.commands {
+		if sup, found := s.running[cmd.name]; found {
+			managers = append(managers, sup.pm)
+		}
+	}
+
+	return managers
+}
+
+// Read commands from a file with the given parser, without exiting on errors like loadCommands and loadConfig
+func readCommandFile(filePath string, parse func(io.Reader) ([]command, error)) ([]command, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parse(file)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Status snapshots are taken from other goroutines while a reload is being applied,
+// they must never see a command whose manager is stopped but not started again yet
+func TestManagersDuringReload(t *testing.T) {
+	sup := newSupervisor(testSink(), 0, false, newResourcePools(nil))
+
+	// web is gone as soon as it is stopped, worker ignores SIGTERM and takes its whole grace period,
+	// so web is stopped and not started again for a while during the reload
+	web := testCommand("web", "sleep")
+	worker := testCommand("worker", "hang")
+	worker.grace = 300 * time.Millisecond
+	sup.apply([]command{web, worker})
+	for _, pm := range sup.managers() {
+		waitForState(t, pm, stateRunning)
+	}
+
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		polls := 0
+		for {
+			select {
+			case <-done:
+				polled <- polls
+				return
+			default:
+			}
+
+			for _, pm := range sup.managers() {
+				pm.snapshot()
+			}
+			polls++
+		}
+	}()
+
+	// Changing both makes the reload stop both before starting them again
+	web.restartDelay = 2 * time.Second
+	worker.restartDelay = 2 * time.Second
+	sup.apply([]command{web, worker})
+
+	close(done)
+	if polls := <-polled; polls == 0 {
+		t.Fatal("managers was not polled during the reload")
+	}
+
+	managers := sup.managers()
+	if len(managers) != 2 || managers[0].cmd.restartDelay != web.restartDelay || managers[1].cmd.restartDelay != worker.restartDelay {
+		t.Fatalf("managers after the reload = %v, want the changed commands", managers)
+	}
+
+	sup.stopAll()
+	sup.wg.Wait()
+}
+
+// Wait for a process manager to reach a state, failing the test if it takes too long
+func waitForState(t *testing.T, pm *processManager, state string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if current, _ := pm.status(); current == state {
+			return
+		}
+	}
+
+	current, _ := pm.status()
+	t.Fatalf("process %s is %q, want %q", pm.cmd.name, current, state)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A named resource, like a GPU or a license, with a fixed number of slots that processes take turns using
+// A process holds one slot of every resource it needs while it runs, and waits for one to be free before starting
+type resourcePool struct {
+	name string
+
+	mu sync.Mutex
+
+	// Name of the process holding each slot, empty if the slot is free
+	holders []string
+
+	// Closed and replaced whenever a slot is freed, to wake up processes waiting for one
+	freed chan struct{}
+}
+
+// The resource pools of the runner by name
+// Resources without a configured capacity have a single slot, so they are exclusive
+type resourcePools struct {
+	mu    sync.Mutex
+	pools map[string]*resourcePool
+}
+
+// Create the pools from the capacities given with -resource
+func newResourcePools(capacities map[string]int) *resourcePools {
+	r := &resourcePools{pools: make(map[string]*resourcePool)}
+
+	for name, capacity := range capacities {
+		r.pools[name] = &resourcePool{name: name, holders: make([]string, capacity), freed: make(chan struct{})}
+	}
+
+	return r
+}
+
+// Return the pool of a resource, creating a single slot pool for resources without a capacity
+func (r *resourcePools) get(name string) *resourcePool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool, found := r.pools[name]
+	if !found {
+		pool = &resourcePool{name: name, holders: make([]string, 1), freed: make(chan struct{})}
+		r.pools[name] = pool
+	}
+
+	return pool
+}
+
+// Take a free slot for a process, waiting until one is free
+// waiting is called once if there is no free slot straight away
+// Returns the index of the slot, or false if quit was closed first
+func (p *resourcePool) acquire(holder string, quit <-chan bool, waiting func()) (int, bool) {
+	for waited := false; ; waited = true {
+		p.mu.Lock()
+		for slot, current := range p.holders {
+			if current == "" {
+				p.holders[slot] = holder
+				p.mu.Unlock()
+				return slot, true
+			}
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		if !waited {
+			waiting()
+		}
+
+		select {
+		case <-quit:
+			return 0, false
+		case <-freed:
+		}
+	}
+}
+
+// Give a slot back
+func (p *resourcePool) release(slot int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.holders[slot] = ""
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// Return the name of the process holding each slot, empty for free slots
+func (p *resourcePool) occupancy() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.holders...)
+}
+
+// Return the occupancy of every pool by name
+func (r *resourcePools) occupancy() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	occupancy := make(map[string][]string)
+	for name, pool := range r.pools {
+		occupancy[name] = pool.occupancy()
+	}
+
+	return occupancy
+}
+
+// Name of the environment variable that tells a process which slot of a resource it has, like LSR_RESOURCE_GPU
+func resourceEnvName(resource string) string {
+	return "LSR_RESOURCE_" + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, resource)
+}
+
+// Take a slot of every resource the command needs, in name order so two processes never wait for each other
+// Returns the environment variables with the slot numbers and a function that gives the slots back,
+// or false if quit was closed while waiting
+func (pm *processManager) acquireResources(quit <-chan bool, incarnation string) ([]string, func(), bool) {
+	var env []string
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	for _, name := range pm.cmd.resources {
+		pool := pm.resources.get(name)
+
+		slot, ok := pool.acquire(pm.cmd.name, quit, func() {
+			slog.Info("resource_waiting", "process", pm.cmd.name, "incarnation", incarnation, "resource", name)
+			pm.setState(stateWaiting)
+			pm.heartbeat.idle()
+		})
+		pm.heartbeat.working(0)
+		if !ok {
+			release()
+			return nil, nil, false
+		}
+
+		slog.Info("resource_acquired", "process", pm.cmd.name, "incarnation", incarnation, "resource", name, "slot", slot)
+		releases = append(releases, func() { pool.release(slot) })
+		env = append(env, resourceEnvName(name)+"="+strconv.Itoa(slot))
+	}
+
+	return env, release, true
+}
+
+// Parse a -resource flag like gpu=2 into the name and capacity
+func parseResourceCapacity(s string) (string, int, error) {
+	name, capacityText, found := strings.Cut(s, "=")
+	if !found || strings.TrimSpace(name) == "" {
+		return "", 0, fmt.Errorf("resource %q must look like name=capacity", s)
+	}
+
+	capacity, err := strconv.Atoi(capacityText)
+	if err != nil || capacity <= 0 {
+		return "", 0, fmt.Errorf("resource %q must have a capacity of at least 1", s)
+	}
+
+	return name, capacity, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Environment variable holding the secret key when no key file is given
+const secretKeyEnv = "LSR_SECRET_KEY"
+
+// Encrypted values in the configuration look like ENC[...] with base64 data inside
+const (
+	encryptedPrefix = "ENC["
+	encryptedSuffix = "]"
+)
+
+// Secrets are replaced with this in output and logs
+const secretMask = "*****"
+
+// Shorter values are not masked, they would hide too much ordinary output
+const minSecretLength = 6
+
+// Create a replacer that masks the secrets, or nil if there is nothing to mask
+func secretReplacer(secrets []string) *strings.Replacer {
+	var long []string
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			long = append(long, secret)
+		}
+	}
+
+	if len(long) == 0 {
+		return nil
+	}
+
+	// Longer secrets first, so a secret that contains another is masked as a whole
+	slices.SortFunc(long, func(a, b string) int { return len(b) - len(a) })
+
+	var pairs []string
+	for _, secret := range long {
+		pairs = append(pairs, secret, secretMask)
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+// Mask the secrets in a string that is about to be logged
+func maskSecrets(s string, secrets []string) string {
+	if r := secretReplacer(secrets); r != nil {
+		return r.Replace(s)
+	}
+
+	return s
+}
+
+// Load the key used to decrypt values in the configuration
+// The key is 32 random bytes, base64 encoded, read from the file or else from LSR_SECRET_KEY
+// Returns nil if no key is given
+func loadSecretKey(path string) ([]byte, error) {
+	encoded := os.Getenv(secretKeyEnv)
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secret key is not valid base64: %w", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret key is %d bytes, expected 32", len(key))
+	}
+
+	return key, nil
+}
+
+// Create an AES-256-GCM cipher for the key
+func secretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a value so it can be put in the configuration
+func encryptValue(plaintext string, key []byte) (string, error) {
+	aead, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	// A fresh random nonce goes in front of the sealed data
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed) + encryptedSuffix, nil
+}
+
+// Check whether a configuration value is encrypted
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix) && strings.HasSuffix(value, encryptedSuffix)
+}
+
+// Decrypt a configuration value, values that are not encrypted are returned unchanged
+func decryptValue(value string, key []byte) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	if key == nil {
+		return "", fmt.Errorf("encrypted value found but no secret key given, use -secret-key-file or %s", secretKeyEnv)
+	}
+
+	aead, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value[len(encryptedPrefix) : len(value)-len(encryptedSuffix)])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is malformed")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("encrypted value can not be decrypted with this key")
+	}
+
+	return string(plaintext), nil
+}
+
+// Encrypt a value read from standard input and print it, then exit
+// Used to prepare values for the configuration
+func runEncrypt(key []byte) {
+	if key == nil {
+		slog.Error("missing_secret_key", "env", secretKeyEnv)
+		os.Exit(1)
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		slog.Error("failed_to_read_stdin", "error", err)
+		os.Exit(1)
+	}
+
+	// Allow echo and here documents without the final newline ending up in the secret
+	plaintext := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+
+	value, err := encryptValue(plaintext, key)
+	if err != nil {
+		slog.Error("failed_to_encrypt", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(value)
+	os.Exit(0)
+}
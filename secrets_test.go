@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestMaskSecrets(t *testing.T) {
+	tests := []struct {
+		s       string
+		secrets []string
+		want    string
+	}{
+		{"token=s3cret-token", []string{"s3cret-token"}, "token=*****"},
+		{"short abc stays", []string{"abc"}, "short abc stays"},
+		{"s3cret-token-2 and s3cret-token", []string{"s3cret-token", "s3cret-token-2"}, "***** and *****"},
+		{"nothing to hide", nil, "nothing to hide"},
+	}
+
+	for _, test := range tests {
+		if got := maskSecrets(test.s, test.secrets); got != test.want {
+			t.Errorf("maskSecrets(%q, %q) = %q, want %q", test.s, test.secrets, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Split a command line into arguments the way a shell would
+// Single quotes keep everything up to the next single quote as is
+// Double quotes keep everything up to the next double quote, a backslash escapes " and \ inside them,
+// so a quoted path can end in a backslash written as \\
+// Outside quotes a backslash escapes a quote or whitespace,
+// any other backslash is kept so Windows paths like C:\tools\app.exe and \\server\share\app.exe work unquoted
+// If lookup is not nil, $NAME and ${NAME} outside single quotes are replaced by lookup(NAME)
+// and a backslash also escapes $, expanded values are never split into several arguments
+func splitCommandLine(line string, lookup func(string) string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+
+	// Whether an argument has been started, so "" gives an empty argument
+	inArg := false
+
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			i += size
+
+		case r == '\'':
+			inArg = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+
+			arg.WriteString(line[i+1 : i+1+end])
+			i += end + 2
+
+		case r == '"':
+			inArg = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if lookup != nil && line[i] == '$' {
+					value, length, err := expandVariable(line[i:], lookup)
+					if err != nil {
+						return nil, err
+					}
+
+					arg.WriteString(value)
+					i += length - 1
+					continue
+				}
+
+				if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\' || (lookup != nil && line[i+1] == '$')) {
+					i++
+				}
+
+				arg.WriteByte(line[i])
+			}
+
+			if i >= len(line) {
+				return nil, errors.New("unterminated double quote")
+			}
+			i++
+
+		case r == '\\' && i+1 < len(line) && (isEscapable(line[i+1:]) || (lookup != nil && line[i+1] == '$')):
+			// Keep the escaped character, which may be more than one byte of whitespace
+			inArg = true
+			_, next := utf8.DecodeRuneInString(line[i+1:])
+			arg.WriteString(line[i+1 : i+1+next])
+			i += 1 + next
+
+		case r == '$' && lookup != nil:
+			value, length, err := expandVariable(line[i:], lookup)
+			if err != nil {
+				return nil, err
+			}
+
+			// Like in a shell, an unquoted variable that is empty does not start an argument
+			if value != "" {
+				inArg = true
+				arg.WriteString(value)
+			}
+			i += length
+
+		default:
+			// Copy the original bytes so invalid UTF-8 is passed through unchanged
+			inArg = true
+			arg.WriteString(line[i : i+size])
+			i += size
+		}
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// Check whether a backslash outside quotes escapes the character at the start of s
+func isEscapable(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '"' || r == '\'' || unicode.IsSpace(r)
+}
+
+// Expand the variable reference at the start of s, which starts with $
+// Returns the value and the length of the reference, a $ without a name is kept as it is
+func expandVariable(s string, lookup func(string) string) (string, int, error) {
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 0, errors.New("unterminated ${")
+		}
+
+		name := s[2:end]
+		if name == "" || variableNameLength(name) != len(name) {
+			return "", 0, fmt.Errorf("invalid variable name %q", name)
+		}
+
+		return lookup(name), end + 1, nil
+	}
+
+	n := variableNameLength(s[1:])
+	if n == 0 {
+		return "$", 1, nil
+	}
+
+	return lookup(s[1 : 1+n]), 1 + n, nil
+}
+
+// Return the length of the variable name at the start of s
+// Names are letters, digits and underscores and do not start with a digit
+func variableNameLength(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (n > 0 && c >= '0' && c <= '9') {
+			n++
+		} else {
+			break
+		}
+	}
+
+	return n
+}
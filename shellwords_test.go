@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`echo "hello world"`, []string{"echo", "hello world"}},
+		{`echo 'a b'`, []string{"echo", "a b"}},
+		{`echo 'a "b" \c'`, []string{"echo", `a "b" \c`}},
+		{`echo "say \"hi\""`, []string{"echo", `say "hi"`}},
+		{`echo say\ \"hi\"`, []string{"echo", `say "hi"`}},
+		{`echo "" ''`, []string{"echo", "", ""}},
+		{`C:\tools\app.exe --dir "C:\Program Files\app"`, []string{`C:\tools\app.exe`, "--dir", `C:\Program Files\app`}},
+		{`\\server\share\app.exe`, []string{`\\server\share\app.exe`}},
+		{`"\\\\server\share\my app.exe" -v`, []string{`\\server\share\my app.exe`, "-v"}},
+		{`app.exe --out "C:\Temp\\"`, []string{"app.exe", "--out", `C:\Temp\`}},
+		{`echo "a\\b" a\\b`, []string{"echo", `a\b`, `a\\b`}},
+		{"  spaced \t out  ", []string{"spaced", "out"}},
+	}
+
+	for _, test := range tests {
+		args, err := splitCommandLine(test.line, nil)
+		if err != nil {
+			t.Errorf("splitCommandLine(%q) failed: %v", test.line, err)
+			continue
+		}
+
+		if !slices.Equal(args, test.want) {
+			t.Errorf("splitCommandLine(%q) = %q, want %q", test.line, args, test.want)
+		}
+	}
+}
+
+func TestSplitCommandLineErrors(t *testing.T) {
+	for _, line := range []string{`echo "hello`, `echo 'hello`, `echo "a\"`, `app.exe "C:\Temp\"`, `echo ${HOME`} {
+		lookup := func(string) string { return "" }
+		if args, err := splitCommandLine(line, lookup); err == nil {
+			t.Errorf("splitCommandLine(%q) = %q, want an error", line, args)
+		}
+	}
+}
+
+// Splitting any command line must not panic, and lines without quotes
+// or backslashes must split exactly like strings.Fields
+func FuzzSplitCommandLine(f *testing.F) {
+	f.Add(`echo "hello world"`)
+	f.Add(`awk '$1 > 5' data.txt`)
+	f.Add(`printf a\ b \"c\" "d\"e" ''`)
+	f.Add(`C:\tools\app.exe --dir "C:\Program Files\app"`)
+	f.Add(`unterminated "quote`)
+	f.Add(`$HOME/bin/app "${DATA_DIR}/x" '$1' \$PATH ${ ${} $`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		args, err := splitCommandLine(line, nil)
+
+		// Expanding must not panic either, whatever the line looks like
+		splitCommandLine(line, func(name string) string { return "<" + name + ">" })
+
+		if strings.ContainsAny(line, `"'\`) {
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", line, err)
+		}
+
+		if fields := strings.Fields(line); !slices.Equal(args, fields) && !(len(args) == 0 && len(fields) == 0) {
+			t.Fatalf("split %q into %q, want %q", line, args, fields)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long to wait for an HTTP status destination to accept a snapshot
+const statusPutTimeout = 30 * time.Second
+
+// The state of the runner and all of its processes at one moment, as written to status destinations
+// Resources lists the process holding each slot of every resource, empty for free slots
+type statusSnapshot struct {
+	Time            time.Time           `json:"time"`
+	Host            string              `json:"host"`
+	Env             string              `json:"env"`
+	Version         string              `json:"version"`
+	Processes       []processSnapshot   `json:"processes"`
+	Groups          []groupSnapshot     `json:"groups,omitempty"`
+	Resources       map[string][]string `json:"resources,omitempty"`
+	SubsystemPanics map[string]int      `json:"subsystem_panics,omitempty"`
+}
+
+// The processes of a group in a status snapshot, with how many are in each state
+type groupSnapshot struct {
+	Name      string         `json:"name"`
+	Processes []string       `json:"processes"`
+	States    map[string]int `json:"states"`
+}
+
+// The state of one process in a status snapshot
+type processSnapshot struct {
+	Name        string        `json:"name"`
+	Group       string        `json:"group,omitempty"`
+	State       string        `json:"state"`
+	Pid         int           `json:"pid,omitempty"`
+	Incarnation string        `json:"incarnation,omitempty"`
+	Starts      int           `json:"starts"`
+	Restarts    int           `json:"restarts"`
+	Failures    int           `json:"failures"`
+	UptimeTotal time.Duration `json:"uptime_total"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	NextRun     *time.Time    `json:"next_run,omitempty"`
+	Killed      bool          `json:"killed"`
+	ExitReason  string        `json:"last_exit_reason,omitempty"`
+	ExitCode    *int          `json:"last_exit_code,omitempty"`
+	Signal      string        `json:"last_signal,omitempty"`
+
+	// When the counts started, they start over when a reload or restart replaces the process manager
+	CountedSince time.Time `json:"-"`
+}
+
+// Return the current state of the process for a status snapshot
+func (pm *processManager) snapshot() processSnapshot {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	s := processSnapshot{
+		Name:        pm.cmd.name,
+		Group:       pm.cmd.group,
+		State:       pm.state,
+		Pid:         pm.pid,
+		Incarnation: pm.incarnation,
+		Starts:      pm.starts,
+		Failures:    pm.failures,
+		UptimeTotal: pm.uptimeTotal,
+		Killed:      pm.killed,
+
+		CountedSince: pm.created,
+	}
+
+	// Every start after the first is a restart
+	if pm.starts > 0 {
+		s.Restarts = pm.starts - 1
+	}
+
+	// A run that is still going counts up to now
+	if pm.pid != 0 {
+		s.UptimeTotal += pm.clock.Now().Sub(pm.startedAt)
+	}
+
+	if !pm.startedAt.IsZero() {
+		startedAt := pm.startedAt
+		s.StartedAt = &startedAt
+	}
+
+	if !pm.nextRun.IsZero() {
+		nextRun := pm.nextRun
+		s.NextRun = &nextRun
+	}
+
+	if pm.lastExit != nil {
+		code := pm.lastExit.code
+		s.ExitReason = pm.lastExit.kind
+		s.ExitCode = &code
+		s.Signal = pm.lastExit.signal
+	}
+
+	return s
+}
+
+// Write a snapshot to a destination: a file, or a URL the snapshot is sent to with HTTP PUT
+// A pre-signed S3 URL is written to like any other URL
+func writeStatus(dest string, data []byte) error {
+	if isStatusURL(dest) {
+		return putStatus(dest, data)
+	}
+
+	return writeStatusFile(dest, data)
+}
+
+// Check whether a status destination is a URL rather than a file
+func isStatusURL(dest string) bool {
+	return strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://")
+}
+
+// Return the destination without the query of a URL, which can hold credentials like the signature of a pre-signed URL
+func statusDestinationName(dest string) string {
+	if isStatusURL(dest) {
+		dest, _, _ = strings.Cut(dest, "?")
+	}
+
+	return dest
+}
+
+// Replace the file with the snapshot, through a temporary file so readers never see half of it
+func writeStatusFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Send the snapshot to a URL with HTTP PUT
+func putStatus(url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: statusPutTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error repeats the URL, which should not end up in the logs with its query
+		if urlErr, ok := err.(*neturl.Error); ok {
+			urlErr.URL = statusDestinationName(urlErr.URL)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Build a snapshot of the runner and the processes of the supervisor
+func takeStatusSnapshot(sup *supervisor, envLabel string) statusSnapshot {
+	hostname, _ := os.Hostname()
+
+	snapshot := statusSnapshot{
+		Time:            time.Now(),
+		Host:            hostname,
+		Env:             envLabel,
+		Version:         runnerVersion(),
+		Processes:       []processSnapshot{},
+		Resources:       sup.resources.occupancy(),
+		SubsystemPanics: subsystemPanicCounts(),
+	}
+
+	for _, pm := range sup.managers() {
+		snapshot.Processes = append(snapshot.Processes, pm.snapshot())
+	}
+	snapshot.Groups = groupSnapshots(snapshot.Processes)
+
+	return snapshot
+}
+
+// Sum up the processes by group, in the order the groups first appear
+func groupSnapshots(processes []processSnapshot) []groupSnapshot {
+	var groups []groupSnapshot
+	index := make(map[string]int)
+
+	for _, p := range processes {
+		if p.Group == "" {
+			continue
+		}
+
+		i, found := index[p.Group]
+		if !found {
+			i = len(groups)
+			index[p.Group] = i
+			groups = append(groups, groupSnapshot{Name: p.Group, States: make(map[string]int)})
+		}
+
+		groups[i].Processes = append(groups[i].Processes, p.Name)
+		groups[i].States[p.State]++
+	}
+
+	return groups
+}
+
+// Write a snapshot to every destination, logging those that fail
+func publishStatus(destinations []string, snapshot statusSnapshot) {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		slog.Error("failed_to_encode_status", "error", err)
+		return
+	}
+
+	for _, dest := range destinations {
+		if err := writeStatus(dest, data); err != nil {
+			slog.Warn("status_publish_failed", "destination", statusDestinationName(dest), "error", err)
+		}
+	}
+}
+
+// Publish a snapshot to the destinations every interval
+func publishStatusPeriodically(destinations []string, interval time.Duration, snapshot func() statusSnapshot) {
+	for {
+		publishStatus(destinations, snapshot())
+		time.Sleep(interval)
+	}
+}
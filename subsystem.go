@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// How long to wait before restarting a background subsystem that panicked
+const subsystemRestartDelay = 10 * time.Second
+
+// Number of panics of each background subsystem, reported on shutdown
+var (
+	subsystemPanicsMu sync.Mutex
+	subsystemPanics   = make(map[string]int)
+)
+
+// Run a background subsystem of the runner, like a file watcher, and restart it if it panics
+// A bug in one of these must not take down the supervision of the processes
+func superviseSubsystem(name string, run func()) {
+	for runSubsystem(name, run) {
+		time.Sleep(subsystemRestartDelay)
+		slog.Info("subsystem_restarting", "subsystem", name)
+	}
+}
+
+// Run a subsystem once, returning true if it panicked
+func runSubsystem(name string, run func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			subsystemPanicsMu.Lock()
+			subsystemPanics[name]++
+			panics := subsystemPanics[name]
+			subsystemPanicsMu.Unlock()
+
+			slog.Error("subsystem_panicked", "subsystem", name, "panic", r, "panics", panics, "stack", string(debug.Stack()))
+			panicked = true
+		}
+	}()
+
+	run()
+	return false
+}
+
+// Return the number of panics of each subsystem that panicked
+func subsystemPanicCounts() map[string]int {
+	subsystemPanicsMu.Lock()
+	defer subsystemPanicsMu.Unlock()
+
+	return maps.Clone(subsystemPanics)
+}
+
+// Log which subsystems panicked while the runner was running, if any
+func logDegradedSubsystems() {
+	subsystemPanicsMu.Lock()
+	defer subsystemPanicsMu.Unlock()
+
+	for name, panics := range subsystemPanics {
+		slog.Warn("subsystem_degraded", "subsystem", name, "panics", panics)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Placeholders for template parameters, like {{queue}}
+// Only plain names match, so Go templates like {{.Names}} in a command line are left alone
+var templateParam = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+// Fill in a process from the template it names, if any
+// Settings of the process win over those of the template, env and params are merged
+// {{name}} in the name, command, env values and paths is replaced with the matching parameter
+func (cfg configFile) applyTemplate(p processConfig) (processConfig, error) {
+	if p.Template == "" {
+		return p, nil
+	}
+
+	t, found := cfg.Templates[p.Template]
+	if !found {
+		return p, fmt.Errorf("unknown template %q", p.Template)
+	}
+	if t.Name != "" || t.Template != "" {
+		return p, fmt.Errorf("template %q can not set a name or use another template", p.Template)
+	}
+
+	// Copy every setting the process sets over the template
+	merged := reflect.ValueOf(&t).Elem()
+	own := reflect.ValueOf(p)
+	for i := 0; i < own.NumField(); i++ {
+		field := own.Field(i)
+		if field.IsZero() {
+			continue
+		}
+
+		if field.Kind() == reflect.Map && !merged.Field(i).IsNil() {
+			combined := reflect.MakeMap(field.Type())
+			for _, source := range []reflect.Value{merged.Field(i), field} {
+				iter := source.MapRange()
+				for iter.Next() {
+					combined.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+			field = combined
+		}
+
+		merged.Field(i).Set(field)
+	}
+
+	var missing []string
+	fill := func(s string) string {
+		return templateParam.ReplaceAllStringFunc(s, func(placeholder string) string {
+			name := templateParam.FindStringSubmatch(placeholder)[1]
+			value, found := t.Params[name]
+			if !found {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+
+	t.Name = fill(t.Name)
+	t.Command = fill(t.Command)
+	t.Group = fill(t.Group)
+	t.OnFailure = fill(t.OnFailure)
+	t.EnvFile = fill(t.EnvFile)
+	t.WorkingDir = fill(t.WorkingDir)
+	t.Listen = fill(t.Listen)
+	t.Upstream = fill(t.Upstream)
+	if t.Env != nil {
+		env := make(map[string]string)
+		for name, value := range t.Env {
+			env[name] = fill(value)
+		}
+		t.Env = env
+	}
+
+	if len(missing) > 0 {
+		return p, fmt.Errorf("template %q has no value for %s", p.Template, strings.Join(missing, ", "))
+	}
+
+	return t, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Check the commands without starting anything, print the settings every process ends up with and exit
+// The settings are printed as a YAML configuration, which can be used with -config as it is
+// apart from masked secrets
+// Exits with 1 if any command has a problem
+func runValidate(commands []command) {
+	problems := checkCommands(commands)
+
+	var cfg configFile
+	for _, cmd := range commands {
+		cfg.Processes = append(cfg.Processes, cmd.resolvedConfig())
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg); err != nil {
+		slog.Error("failed_to_encode_config", "error", err)
+		os.Exit(1)
+	}
+	encoder.Close()
+
+	if problems > 0 {
+		slog.Error("validation_failed", "processes", len(commands), "problems", problems)
+		os.Exit(1)
+	}
+
+	slog.Info("validation_passed", "processes", len(commands))
+	os.Exit(0)
+}
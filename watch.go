@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Flag value that collects every occurrence of a flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// What was last seen of a watched file
+type watchedFile struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+// Look at a watched file
+func statWatchedFile(path string) watchedFile {
+	info, err := os.Stat(path)
+	if err != nil {
+		return watchedFile{}
+	}
+
+	return watchedFile{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// Check whether a watched file looks different from last time
+func (f watchedFile) changed(last watchedFile) bool {
+	return f.exists != last.exists || f.size != last.size || !f.modTime.Equal(last.modTime)
+}
+
+// Poll files and log a warning whenever one of them changes
+// Changes are only reported, nothing is restarted,
+// so operators know a restart may be needed without one being forced
+func watchFiles(paths []string, interval time.Duration) {
+	last := make(map[string]watchedFile)
+
+	for _, path := range paths {
+		last[path] = statWatchedFile(path)
+		slog.Info("watching_file", "file", path, "exists", last[path].exists)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, path := range paths {
+			current := statWatchedFile(path)
+
+			if current.changed(last[path]) {
+				slog.Warn("watched_file_changed",
+					"file", path,
+					"exists", current.exists,
+					"size", current.size,
+					"modified", current.modTime)
+			}
+
+			last[path] = current
+		}
+	}
+}
+
+// Poll the command or config file and signal on changed whenever it changes
+// changed should be buffered, changes while an earlier one has not been handled yet are merged
+func watchConfigFile(path string, interval time.Duration, changed chan<- struct{}) {
+	last := statWatchedFile(path)
+	slog.Info("watching_config", "file", path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current := statWatchedFile(path)
+
+		// A file that is being replaced may be missing for a moment, wait for it to come back
+		if current.exists && current.changed(last) {
+			slog.Info("config_file_changed", "file", path, "size", current.size, "modified", current.modTime)
+
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+
+		last = current
+	}
+}
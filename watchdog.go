@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// How often the watchdog checks the supervision loops, and how long one may stay busy beyond what its work may take
+const (
+	watchdogInterval = 30 * time.Second
+	watchdogTimeout  = 10 * time.Second
+)
+
+// Shows whether a supervision loop is still making progress
+// A loop marks itself busy while it does work that should be over quickly, and idle while it waits for something
+// that may legitimately take long, like a running process, a restart delay or a free resource slot
+type heartbeat struct {
+	mu sync.Mutex
+
+	busy bool
+
+	// When the loop last became busy
+	since time.Time
+
+	// How long the current work may take, on top of the watchdog timeout
+	allowed time.Duration
+}
+
+// Mark the loop busy with work that may take up to allowed
+func (h *heartbeat) working(allowed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.busy = true
+	h.since = time.Now()
+	h.allowed = allowed
+}
+
+// Mark the loop idle while it waits
+func (h *heartbeat) idle() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.busy = false
+}
+
+// Return when the loop became busy if it has been busy for too long at now
+func (h *heartbeat) stuck(now time.Time) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.since, h.busy && now.Sub(h.since) > h.allowed+watchdogTimeout
+}
+
+// A supervision loop the watchdog found stuck
+type stuckLoop struct {
+	// Name of the process the loop supervises, empty for the main loop
+	process string
+
+	beat  *heartbeat
+	since time.Time
+}
+
+// Return the loops that have been busy for too long at now, the main loop and the run loops of the managers
+func stuckLoops(main *heartbeat, managers []*processManager, now time.Time) []stuckLoop {
+	var stuck []stuckLoop
+
+	if since, ok := main.stuck(now); ok {
+		stuck = append(stuck, stuckLoop{beat: main, since: since})
+	}
+
+	for _, pm := range managers {
+		if since, ok := pm.heartbeat.stuck(now); ok {
+			stuck = append(stuck, stuckLoop{process: pm.cmd.name, beat: &pm.heartbeat, since: since})
+		}
+	}
+
+	return stuck
+}
+
+// Check that the main loop and the run loop of every process manager keep making progress, to catch hangs in the
+// runner itself, like a manager blocked writing output or the main loop stuck applying a reload
+// Every stretch a loop is stuck for is reported once, together with the stacks of all goroutines
+func runWatchdog(main *heartbeat, managers func() []*processManager) {
+	reported := make(map[*heartbeat]time.Time)
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, loop := range stuckLoops(main, managers(), now) {
+			if reported[loop.beat].Equal(loop.since) {
+				continue
+			}
+			reported[loop.beat] = loop.since
+
+			attrs := []any{"loop", "main"}
+			if loop.process != "" {
+				attrs = []any{"loop", "process", "process", loop.process}
+			}
+			attrs = append(attrs, "busy_for", now.Sub(loop.since), "stacks", goroutineStacks())
+			slog.Error("watchdog_stuck", attrs...)
+		}
+	}
+}
+
+// Return the stacks of all goroutines
+func goroutineStacks() string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A manager blocked inside the runner is reported, one waiting for a busy resource slot is not
+func TestWatchdogFindsBlockedManager(t *testing.T) {
+	pools := newResourcePools(map[string]int{"gpu": 1})
+
+	// Take the only gpu slot, so the waiting manager has to wait for it like it would for another process
+	slot, _ := pools.get("gpu").acquire("other", nil, func() {})
+
+	waitingCmd := testCommand("waiting", "sleep")
+	waitingCmd.resources = []string{"gpu"}
+	waiting := newProcessManager(waitingCmd, testSink(), realClock{})
+	waiting.resources = pools
+
+	// Hold the lock of the pools, so the blocked manager gets stuck looking up its resource
+	blockedCmd := testCommand("blocked", "sleep")
+	blockedCmd.resources = []string{"license"}
+	blocked := newProcessManager(blockedCmd, testSink(), realClock{})
+	blocked.resources = pools
+
+	var wg sync.WaitGroup
+	quit := make(chan bool)
+	wg.Add(1)
+	go waiting.run(&wg, quit)
+	waitForState(t, waiting, stateWaiting)
+
+	pools.mu.Lock()
+	wg.Add(1)
+	go blocked.run(&wg, quit)
+	time.Sleep(100 * time.Millisecond)
+
+	var main heartbeat
+	stuck := stuckLoops(&main, []*processManager{waiting, blocked}, time.Now().Add(time.Minute))
+
+	pools.mu.Unlock()
+	close(quit)
+	pools.get("gpu").release(slot)
+	wg.Wait()
+
+	if len(stuck) != 1 || stuck[0].process != "blocked" {
+		t.Fatalf("stuck loops %+v, want only blocked", stuck)
+	}
+
+	// Nothing is stuck once the managers have ended
+	if stuck := stuckLoops(&main, []*processManager{waiting, blocked}, time.Now().Add(time.Minute)); len(stuck) != 0 {
+		t.Errorf("stuck loops %+v after the managers ended", stuck)
+	}
+}
+
+// The main loop may take as long as it was allowed before it counts as stuck
+func TestWatchdogAllowance(t *testing.T) {
+	var main heartbeat
+	main.working(time.Minute)
+
+	if stuck := stuckLoops(&main, nil, time.Now().Add(time.Minute)); len(stuck) != 0 {
+		t.Errorf("stuck loops %+v within the allowance", stuck)
+	}
+
+	if stuck := stuckLoops(&main, nil, time.Now().Add(time.Minute+2*watchdogTimeout)); len(stuck) != 1 || stuck[0].process != "" {
+		t.Errorf("stuck loops %+v, want the main loop", stuck)
+	}
+
+	main.idle()
+	if stuck := stuckLoops(&main, nil, time.Now().Add(time.Hour)); len(stuck) != 0 {
+		t.Errorf("stuck loops %+v while idle", stuck)
+	}
+}